@@ -9,194 +9,2581 @@
 package awswebsocketadapter
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go/service/apigatewaymanagementapi/apigatewaymanagementapiiface"
 	"github.com/gorilla/websocket"
+
+	"github.com/armsnyder/awswebsocketadapter/internal/connid"
+)
+
+const (
+	defaultCloseHandshakeTimeout  = 5 * time.Second
+	defaultConnectTimeout         = 5 * time.Second
+	defaultInvocationTimeout      = 30 * time.Second
+	defaultReadyBufferSize        = 100
+	defaultAsyncDisconnectWorkers = 16
+	defaultDomainName             = "localhost"
+
+	// requestTimeFormat is the format of the RequestTime of API Gateway events.
+	requestTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+// ErrFatal can be wrapped in an error returned by the handler for a MESSAGE event, to make the
+// adapter close the connection instead of replying with an error message and keeping it open.
+//
+//	return resp, fmt.Errorf("corrupt session: %w", awswebsocketadapter.ErrFatal)
+var ErrFatal = errors.New("fatal handler error")
+
+// The event types of the events that the adapter invokes the handler with, as in
+// events.APIGatewayWebsocketProxyRequestContext.EventType.
+const (
+	EventTypeConnect    = "CONNECT"
+	EventTypeMessage    = "MESSAGE"
+	EventTypeDisconnect = "DISCONNECT"
 )
 
+// LambdaHandler is the signature of a Lambda function handler for websocket events. Concerns such as
+// tracing are best added by wrapping it, as in Lambda: a wrapper can start a span per invocation,
+// named by RequestContext.EventType, continue the client's trace from TraceHeadersFromContext, and
+// record the returned error and status code.
 type LambdaHandler func(context.Context, events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error)
 
 // Adapter is an implementation of an API Gateway Websocket API that invokes an AWS Lambda
 // function in-memory. It is a handler that upgrades requests to websockets and invokes an AWS
 // Lambda handler on each message. It also provides API Gateway Management APIs for writing back to
 // connections.
+//
+// Handler contexts derive from the context of the connection's upgrade request, so they carry its
+// values and are canceled along with it. MESSAGE handler contexts are also canceled once the
+// connection closes, starts closing, or fails a write, so that long-running handlers can stop
+// early. The DISCONNECT handler's context only carries the values, so that it can clean up after
+// the connection is gone.
+//
+// The MESSAGE handler is invoked for the messages of a connection one at a time, in the order that
+// they were received, including messages injected with InjectMessage. Messages of different
+// connections are handled concurrently.
+//
+// The DISCONNECT handler runs after the connection has been removed, like in API Gateway: writing
+// to the connection from within it fails with a *apigatewaymanagementapi.GoneException, and no
+// MESSAGE handler of the connection runs after it starts.
 type Adapter struct {
 	LambdaHandler LambdaHandler
 
-	upgrader websocket.Upgrader
+	// InvocationTimeout is the time limit of every handler invocation, after which its context is
+	// cancelled. Defaults to 30 seconds. A negative value means no time limit. CONNECT invocations
+	// are further limited by ConnectTimeout.
+	InvocationTimeout time.Duration
+
+	// RouteSelectionExpression selects the RouteKey of MESSAGE events from their JSON body, like the
+	// route selection expression of an API Gateway websocket API, e.g. "$request.body.action" or
+	// "$request.body.meta.action" for a nested field. Messages without the selected field, or that
+	// are not JSON, get the "$default" route key, as do all messages if it is empty. CONNECT and
+	// DISCONNECT events always get "$connect" and "$disconnect".
+	RouteSelectionExpression string
+
+	// Handlers maps route keys to the handlers of their routes, like the integrations of an API
+	// Gateway websocket API, e.g. "$connect", "sendMessage" or "$default". MESSAGE events whose
+	// route key has no handler go to the "$default" handler. Events without any handler in
+	// Handlers go to LambdaHandler. If that is nil too, CONNECT and DISCONNECT events succeed, as
+	// in an API without those routes, and messages are answered with an error message.
+	Handlers map[string]LambdaHandler
+
+	// CloseHandshakeTimeout bounds how long the adapter waits for the client to acknowledge a close
+	// frame sent by the server before the connection is torn down. Defaults to 5 seconds.
+	CloseHandshakeTimeout time.Duration
+
+	// FirstMessageAuth, if set, receives the first message of every connection instead of the
+	// Lambda handler. This supports browser clients, which cannot send custom handshake headers and
+	// authenticate in their first message instead. The returned map becomes the
+	// RequestContext.Authorizer of all subsequent events on the connection. If it returns an error,
+	// the connection is closed.
+	FirstMessageAuth func(connID string, msg []byte) (map[string]interface{}, error)
+
+	// OutboundLatency and OutboundJitter delay every message written to a client by
+	// OutboundLatency plus a random duration of up to OutboundJitter, to simulate a slow network.
+	OutboundLatency time.Duration
+	OutboundJitter  time.Duration
+
+	// ContentTypeDetector classifies the body of every MESSAGE event, so that handlers serving
+	// several message protocols on one route can branch on it via ContentTypeFromContext. Defaults
+	// to DetectContentType.
+	ContentTypeDetector func([]byte) string
+
+	// MaxConnectionsPerIP limits the number of simultaneous connections from a single IP address.
+	// Upgrade requests beyond the limit are rejected with HTTP 429. Zero means no limit. Connections
+	// are counted by the address of the peer, not by X-Forwarded-For, which clients can set freely.
+	MaxConnectionsPerIP int
+
+	// MaxConnections limits the number of simultaneous connections. Upgrade requests beyond the
+	// limit are rejected with HTTP 503, without invoking the CONNECT handler, unless SheddingPolicy
+	// makes room for them. Zero means no limit.
+	MaxConnections int
+
+	// SheddingPolicy selects what happens when a new connection would exceed MaxConnections, to
+	// model load shedding. ShedCloseCode is the close code of the connections that it closes, even
+	// if the CONNECT handler then refuses the new connection. Defaults to 1013 (try again later).
+	SheddingPolicy SheddingPolicy
+	ShedCloseCode  int
+
+	// ConnectTimeout is the time limit of the CONNECT handler, which API Gateway keeps shorter than
+	// that of other events. If the CONNECT handler exceeds it, the handshake is refused with HTTP
+	// 504. Defaults to 5 seconds.
+	ConnectTimeout time.Duration
+
+	// RequestInterceptor, if set, may modify every request just before it is passed to the Lambda
+	// handler, for all event types.
+	RequestInterceptor func(*events.APIGatewayWebsocketProxyRequest)
+
+	// ResponseInterceptor, if set, may modify every response returned by the Lambda handler before
+	// the adapter acts on it, e.g. to normalize status codes.
+	ResponseInterceptor func(eventType, connID string, resp *events.APIGatewayProxyResponse)
+
+	// Metrics, if set, receives measurements of the adapter's traffic.
+	Metrics Metrics
+
+	// FrameDelimiter, if non-zero, splits every text frame on the given byte, e.g. '\n' for
+	// newline-delimited JSON. Each non-empty segment is delivered to the handler as its own MESSAGE
+	// event, in order.
+	FrameDelimiter byte
+
+	// CircuitOpenMessage is sent to the client instead of invoking the handler for every message
+	// received while the circuit is open (see OpenCircuit). If it is nil, the reply is the message
+	// of ErrorResponseFunc, or else {"message": "Service unavailable"} with the message ID as "id"
+	// if there is one.
+	CircuitOpenMessage []byte
+
+	// CircuitRejectsConnect refuses new connections with HTTP 503 while the circuit is open,
+	// without invoking the CONNECT handler.
+	CircuitRejectsConnect bool
+
+	// CircuitSkipsDisconnect skips the DISCONNECT handler of connections that close while the
+	// circuit is open.
+	CircuitSkipsDisconnect bool
+
+	// TraceHeaders names the headers of the upgrade request that carry tracing context. They are
+	// available to the handler of every event on the connection via TraceHeadersFromContext.
+	// Defaults to the W3C Trace Context headers, traceparent and tracestate.
+	TraceHeaders []string
+
+	// YieldEvery makes a connection's read loop yield the processor after every YieldEvery
+	// messages, so that a single connection flooding the adapter cannot starve the others. Zero
+	// disables yielding.
+	YieldEvery int
+
+	// OutboundFilter, if set, is consulted before every message written to a client. If it
+	// returns false, the message is silently dropped for that connection without an error.
+	OutboundFilter func(connID string, data []byte) bool
+
+	// OnUndeliverable, if set, is called with every message that PostToConnection fails to deliver
+	// because the connection is gone or the write failed, e.g. to implement a dead-letter queue.
+	OnUndeliverable func(connID string, data []byte, err error)
+
+	// Fallback, if set, receives management API calls for connection IDs that the adapter does not
+	// own, e.g. a real API Gateway client in a hybrid setup where some clients connect to AWS.
+	Fallback apigatewaymanagementapiiface.ApiGatewayManagementApiAPI
+
+	// ForeignConnectionIDPrefixes lists the ConnectionIDPrefix of other adapters, such as those of
+	// the other APIs in a test with several of them. Management API calls for connection IDs with
+	// one of the prefixes fail with a *apigatewaymanagementapi.ForbiddenException, as they do in
+	// AWS for a connection of another API, rather than a GoneException, and skip Fallback.
+	ForeignConnectionIDPrefixes []string
+
+	// RequireReady holds back incoming messages until MarkReady is called, e.g. while an embedding
+	// application is still initializing the handler. Up to ReadyBufferSize messages per connection
+	// are queued and replayed in order once the adapter is ready; further messages are answered with
+	// an error. Defaults to 100 messages.
+	RequireReady    bool
+	ReadyBufferSize int
+
+	// MessageIDField names a top-level field of JSON messages that holds a client-provided message
+	// ID. The ID is available to the handler via MessageIDFromContext, so that it can echo it in
+	// replies, and is included as "id" in the error messages that the adapter sends.
+	MessageIDField string
+
+	// AsyncDisconnect invokes DISCONNECT handlers in the background, so that a closed connection's
+	// goroutine and socket are released without waiting for the handler. At most
+	// AsyncDisconnectWorkers of these handlers run at once; the rest wait their turn. Defaults to
+	// 16 workers.
+	AsyncDisconnect        bool
+	AsyncDisconnectWorkers int
+
+	// OnShutdownDisconnect, if set, is called once with the IDs of all connections that Shutdown
+	// closed, after they have closed, instead of invoking the DISCONNECT handler for each of them,
+	// so that their cleanup can be done in bulk. This deviates from API Gateway, which invokes the
+	// DISCONNECT route once per connection. Connections that close for another reason during
+	// Shutdown still get their DISCONNECT events.
+	OnShutdownDisconnect func(connIDs []string)
+
+	// CompressionLevelFunc, if set, chooses the deflate level (see compress/flate) of messages
+	// written to each new connection, trading CPU for bandwidth per connection. It only has an effect
+	// on connections that negotiated compression.
+	CompressionLevelFunc func(connID string, r *http.Request) int
+
+	// SlowHandlerThreshold, if set, reports handler invocations that are still running after the
+	// given duration, since a slow handler blocks further reads from its connection. They are
+	// reported to OnSlowHandler, or logged if it is nil. The invocation itself continues.
+	SlowHandlerThreshold time.Duration
+	OnSlowHandler        func(connID, eventType string, elapsed time.Duration)
+
+	// DecompressMessages treats every message as a base64-encoded gzip payload, as sent by
+	// bandwidth-constrained clients, and delivers the decompressed text as the event body. Messages
+	// that cannot be decompressed are answered with the message of ErrorResponseFunc, or else
+	// {"message": "Invalid compressed message"}.
+	DecompressMessages bool
+
+	// HeartbeatInterval, if set, sends HeartbeatMessage to every connection at the given interval,
+	// for clients that expect an application-level heartbeat rather than protocol-level pings. If
+	// HeartbeatMessage is nil, a ping control frame is sent instead. Unlike PingInterval, this does
+	// not close connections that stop answering.
+	HeartbeatInterval time.Duration
+	HeartbeatMessage  []byte
+
+	// ConnectionIDPrefix is prepended to every generated connection ID, to keep the IDs of several
+	// adapters that share a Fallback apart. Management API calls take the full, prefixed ID.
+	ConnectionIDPrefix string
+
+	// ConnectionIDFunc, if set, generates the connection ID of every new connection, such as a
+	// sequential counter for deterministic tests, or a UUID. The default is 8 random bytes, base64
+	// encoded. A generated ID that belongs to another connection is handled according to
+	// DuplicateConnectionPolicy.
+	ConnectionIDFunc func() (string, error)
+
+	// DuplicateConnectionPolicy selects what happens when ConnectionIDFunc generates the ID of
+	// another connection. By default, the new connection is refused with 409 Conflict.
+	DuplicateConnectionPolicy DuplicateConnectionPolicy
+
+	// WarnOnDiscardedBody logs a warning whenever a handler responds successfully with a body.
+	// The body of a response never reaches the client; handlers must use PostToConnection instead.
+	WarnOnDiscardedBody bool
+
+	// Logger receives the log messages of the adapter. The default writes them to the standard log
+	// package.
+	Logger Logger
+
+	// Stage, DomainName and APIID populate the corresponding fields of the request context of every
+	// event, which handlers in AWS use to build the management endpoint https://{DomainName}/{Stage}.
+	// If DomainName is empty, it is the Host header of the connection's upgrade request, including
+	// the port, so that the endpoint reaches the adapter if it is served over TLS, such as with
+	// NewTLSServer. The adapter serves the management API at /{Stage}/@connections/{connectionId}
+	// for such clients, without authenticating them.
+	Stage      string
+	DomainName string
+	APIID      string
+
+	// RequiredHeaders lists headers that every upgrade request must carry, such as X-Api-Key. A
+	// handshake that lacks any of them is refused with 400 Bad Request, without invoking the
+	// CONNECT handler.
+	RequiredHeaders []string
+
+	// PingInterval, if set, sends a ping control frame to every connection at the given interval,
+	// and closes connections that do not answer with a pong within twice the interval, so that
+	// clients that vanish without closing their connection are disconnected.
+	PingInterval time.Duration
+
+	// IdleTimeout, if set, closes connections that send no message for the given duration, with
+	// close code 1000 and the reason "idle timeout". The DISCONNECT handler sees the reason
+	// DisconnectIdleTimeout.
+	IdleTimeout time.Duration
+
+	// ErrorResponseFunc, if set, returns the message sent to the client when its message could not
+	// be handled, such as when the MESSAGE handler fails with err or the circuit is open. id is the
+	// message's ID if MessageIDField is set and the message has one, or nil. The default is
+	// {"message": "Internal server error"}, with the message ID as "id" if there is one. The error
+	// may contain internal details, so it should not be sent to the client verbatim.
+	ErrorResponseFunc func(id json.RawMessage, err error) []byte
+
+	// OnConnect, OnMessage and OnDisconnect, if set, are called for every connection, e.g. to record
+	// metrics. OnConnect is called once the CONNECT handler has succeeded and the connection is
+	// open, before any MESSAGE handler. OnMessage is called after each MESSAGE handler returns,
+	// whether it failed or not, with the size of the message and the duration of the handler.
+	// OnDisconnect is called once the connection has closed, for whatever reason, with its close
+	// code and text, before the DISCONNECT handler. OnDisconnect is only called for connections
+	// that OnConnect was called for.
+	OnConnect    func(connID string)
+	OnMessage    func(connID string, size int, duration time.Duration)
+	OnDisconnect func(connID string, code int, reason string)
+
+	// RelayErrorBodies sends the body of a MESSAGE handler's response with a status code other than
+	// 2xx to the client as is, instead of the error message of ErrorResponseFunc, so that handlers
+	// can send structured errors. Responses without a body and handler errors still get the error
+	// message.
+	RelayErrorBodies bool
+
+	// MaxConcurrentInvocations, if set, limits how many handler invocations run at the same time
+	// across all connections. Further events wait for a running invocation to finish, which holds
+	// up reading from their connections. Zero means no limit.
+	MaxConcurrentInvocations int
+
+	// AllowBinaryMessages accepts binary messages, which API Gateway does not support, instead of
+	// closing the connection. Their event body is base64-encoded, with IsBase64Encoded set, like the
+	// binary payloads of Lambda proxy integrations. PostBinaryToConnection writes binary messages.
+	AllowBinaryMessages bool
+
+	// WriteTimeout, if set, bounds how long a write to a connection may take, so that a client that
+	// stops reading fails PostToConnection rather than blocking it. A connection whose write times
+	// out is closed. Zero means no timeout.
+	WriteTimeout time.Duration
+
+	// MaxMessageSize, if set, limits the size in bytes of messages from clients. A client that
+	// sends a larger message is disconnected with close code MessageTooBigCloseCode.
+	MaxMessageSize int64
+
+	// MessageTooBigCloseCode is the close code with which clients are disconnected for exceeding
+	// MaxMessageSize. Defaults to 1009 (message too big). MessageTooBigCloseCodeFunc, if set,
+	// chooses it per connection instead, e.g. by the client's user agent, and may return zero for
+	// the default.
+	MessageTooBigCloseCode     int
+	MessageTooBigCloseCodeFunc func(connID string, r *http.Request) int
+
+	// Upgrader configures the upgrade of requests to websockets, such as buffer sizes, compression,
+	// the handshake timeout and supported subprotocols. Unlike gorilla's default, a nil CheckOrigin
+	// accepts every origin, and a nil WriteBufferPool shares write buffers between the adapter's
+	// connections with the same WriteBufferSize, unless DisableWriteBufferPool is set.
+	Upgrader websocket.Upgrader
+
+	// DisableWriteBufferPool gives every connection its own write buffer for its whole lifetime, as
+	// gorilla does by default, if Upgrader.WriteBufferPool is nil.
+	DisableWriteBufferPool bool
+
+	// writeBufferPools holds the write buffers of the connections between writes, by buffer size,
+	// as gorilla requires a separate pool for every buffer size.
+	writeBufferPoolsMu sync.Mutex
+	writeBufferPools   map[int]*sync.Pool
+
+	connsMu sync.Mutex
+	conns   map[string]*connection
+	ipConns map[string]int
+
+	// connIDs counts the connections that hold each ID, from the start of their handshake until
+	// they close, which is longer than they are in conns. A connection taken over with
+	// DuplicateTakeover holds its ID together with the connection that replaces it.
+	connIDs map[string]int
 
-	writersMu sync.Mutex
-	writers   map[string]io.Writer
+	// shedding is the number of connections closed by SheddingPolicy that still hold their ID. They
+	// do not count towards MaxConnections.
+	shedding int
+
+	// shuttingDown is set by Shutdown, after which serving tracks no new ServeHTTP calls.
+	shuttingDown bool
+	serving      sync.WaitGroup
+
+	// shutdownConnIDs collects the IDs of the connections closed by Shutdown for
+	// OnShutdownDisconnect.
+	shutdownConnIDs []string
+
+	circuitOpen int32
+
+	observersMu sync.Mutex
+	observers   []LambdaHandler
+
+	readyOnce     sync.Once
+	markReadyOnce sync.Once
+	ready         chan struct{}
+
+	// disconnects tracks the DISCONNECT handlers running in the background.
+	disconnects       sync.WaitGroup
+	disconnectSemOnce sync.Once
+	disconnectSem     chan struct{}
+
+	invocationSemOnce sync.Once
+	invocationSem     chan struct{}
+
+	// totals holds the counters of Stats. They are guarded by a mutex rather than updated
+	// atomically, because 64-bit atomics need an alignment that Adapter cannot guarantee on 32-bit
+	// platforms when it is embedded in another struct.
+	totalsMu sync.Mutex
+	totals   Stats
+}
+
+// connection holds the state of a single open websocket connection.
+type connection struct {
+	id     string
+	ws     *websocket.Conn
+	header http.Header
+	tls    *tls.ConnectionState
+	trace  http.Header
+
+	// subprotocol is the negotiated websocket subprotocol, if any.
+	subprotocol string
+
+	// shed is set once SheddingPolicy closes the connection. It is guarded by Adapter.connsMu.
+	shed bool
+
+	// tooBigCode is the close code for messages that exceed MaxMessageSize, if it is not 1009, in
+	// which case the adapter enforces MaxMessageSize itself.
+	tooBigCode int
+
+	sourceIP    string
+	userAgent   string
+	domainName  string
+	query       url.Values
+	connectedAt time.Time
+
+	// ctx derives from the context of the upgrade request and is canceled once the connection is
+	// closing or broken. MESSAGE handler contexts derive from it.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// done is closed when the connection closes.
+	done chan struct{}
+
+	// idle closes the connection once it has been idle for IdleTimeout, if set.
+	idle *time.Timer
+
+	// writeMu serializes writes to ws.
+	writeMu sync.Mutex
+
+	// dispatchMu serializes the handling of messages and guards pending, which holds frames
+	// received before the adapter was ready.
+	dispatchMu sync.Mutex
+	pending    []frame
+
+	// mu guards the fields below.
+	mu            sync.Mutex
+	stats         ConnectionStats
+	totalDuration time.Duration
+	authorizer    map[string]interface{}
+	authenticated bool
+	closed        bool
+	onClose       []func(reason string)
+
+	// closing is set once the server has started to close the connection, for the given reason.
+	closing          bool
+	closingReason    DisconnectReason
+	closingCode      int
+	closingReasonMsg string
+}
+
+// DisconnectReason categorizes why a connection closed. The reason is available to the DISCONNECT
+// handler via DisconnectReasonFromContext.
+type DisconnectReason string
+
+const (
+	// DisconnectClientInitiated means that the client closed the connection with a close frame.
+	DisconnectClientInitiated DisconnectReason = "client-initiated"
+
+	// DisconnectError means that the connection failed or was closed by the adapter because of an
+	// error, such as an unsupported message type or a fatal handler error.
+	DisconnectError DisconnectReason = "error"
+
+	// DisconnectDeleted means that the connection was closed by a call to DeleteConnection.
+	DisconnectDeleted DisconnectReason = "deleted"
+
+	// DisconnectShutdown means that the connection was closed by a call to Shutdown.
+	DisconnectShutdown DisconnectReason = "server-shutdown"
+
+	// DisconnectIdleTimeout means that the connection was closed because it exceeded IdleTimeout.
+	DisconnectIdleTimeout DisconnectReason = "idle-timeout"
+
+	// DisconnectShed means that the connection was closed to make room for a new one, according to
+	// SheddingPolicy.
+	DisconnectShed DisconnectReason = "shed"
+
+	// DisconnectReplaced means that the connection was closed because a new connection took over
+	// its ID, with DuplicateTakeover. Its DISCONNECT handler runs with the same connection ID as the
+	// new connection.
+	DisconnectReplaced DisconnectReason = "replaced"
+)
+
+// SheddingPolicy selects how an Adapter handles a new connection that would exceed MaxConnections.
+type SheddingPolicy int
+
+const (
+	// ShedRejectNew refuses the new connection with 503 Service Unavailable. It is the default.
+	ShedRejectNew SheddingPolicy = iota
+
+	// ShedCloseOldest closes the connection that has been open the longest to make room for the new
+	// one.
+	ShedCloseOldest
+
+	// ShedCloseLeastActive closes the connection that has received no message for the longest time
+	// to make room for the new one.
+	ShedCloseLeastActive
+)
+
+// DuplicateConnectionPolicy selects how an Adapter handles a new connection whose generated ID
+// belongs to another connection.
+type DuplicateConnectionPolicy int
+
+const (
+	// DuplicateReject refuses the new connection with 409 Conflict, without invoking the CONNECT
+	// handler.
+	DuplicateReject DuplicateConnectionPolicy = iota
+
+	// DuplicateTakeover closes the open connection with the ID, with close code 1000 and the reason
+	// "replaced", and accepts the new connection in its place, e.g. to allow only one session per
+	// user. The open connection is closed even if the CONNECT handler then refuses the new one. The
+	// new connection is refused like with DuplicateReject if the other one has not finished its
+	// handshake yet.
+	DuplicateTakeover
+
+	// DuplicateSuffix accepts the new connection with the first free ID of the form "{id}-2",
+	// "{id}-3" and so on.
+	DuplicateSuffix
+)
+
+// ConnectionStats holds statistics about a single connection.
+type ConnectionStats struct {
+	// Invocations is the number of handler invocations made for the connection so far.
+	Invocations int
+
+	// LastHandlerDuration, AvgHandlerDuration and MaxHandlerDuration describe how long the Lambda
+	// handler took to return for the connection's CONNECT, MESSAGE and DISCONNECT events.
+	LastHandlerDuration time.Duration
+	AvgHandlerDuration  time.Duration
+	MaxHandlerDuration  time.Duration
+
+	// Extensions lists the websocket extensions negotiated during the upgrade, such as
+	// "permessage-deflate".
+	Extensions []string
+
+	// LastActiveAt is the time that the last message was received on the connection, or the time it
+	// was opened if it has not received any.
+	LastActiveAt time.Time
+
+	// ProtocolVersion is the application protocol version used by the connection. It is the
+	// websocket subprotocol negotiated during the upgrade, unless it was declared with
+	// SetProtocolVersion, e.g. by a handler that reads it from the client's first message.
+	ProtocolVersion string
 }
 
 // ServeHTTP upgrades the request from HTTP to WS and then continues to send and receive websocket
-// messages over the connection.
+// messages over the connection. It serves requests for /{Stage}/@connections/{connectionId} as
+// calls of the management API instead.
 func (a *Adapter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	if connID, ok := a.managementConnectionID(r); ok {
+		a.serveManagementAPI(w, r, connID)
+		return
+	}
+
+	upgrader := a.Upgrader
+
 	// Disable origin checking.
-	a.upgrader.CheckOrigin = func(_ *http.Request) bool { return true }
+	if upgrader.CheckOrigin == nil {
+		upgrader.CheckOrigin = func(_ *http.Request) bool { return true }
+	}
 
-	// Upgrade the HTTP request to WS.
-	ws, err := a.upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Print("upgrade:", err)
+	// Share write buffers between connections, since most connections are idle most of the time.
+	if upgrader.WriteBufferPool == nil && !a.DisableWriteBufferPool {
+		upgrader.WriteBufferPool = a.writeBufferPool(upgrader.WriteBufferSize)
+		if metrics, ok := a.Metrics.(WriteBufferPoolMetrics); ok {
+			upgrader.WriteBufferPool = observedPool{upgrader.WriteBufferPool, metrics}
+		}
+	}
+
+	if a.LambdaHandler == nil && len(a.Handlers) == 0 {
+		a.logger().Error("no handler configured, set LambdaHandler or Handlers")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	defer ws.Close()
 
-	// Generate a random connection ID.
-	var connIDSrc [8]byte
-	if _, err := rand.Read(connIDSrc[:]); err != nil {
-		log.Print("generate connection ID:", err)
+	if !a.beginServe() {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 		return
 	}
-	connID := base64.StdEncoding.EncodeToString(connIDSrc[:])
+	defer a.serving.Done()
 
-	// Invoke CONNECT handler.
-	if err := a.invokeHandler(connID, "CONNECT", "", r.Header); err != nil {
-		log.Println("handler:", err)
+	if a.CircuitRejectsConnect && a.isCircuitOpen() {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 		return
 	}
 
+	// Enforce the per-IP connection limit.
+	peerIP := remoteIP(r)
+	if !a.acquireIP(peerIP) {
+		a.logger().Warn("too many connections", "remoteIP", peerIP)
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	// Release the slot of the IP address and the connection ID if the connection is refused. Once
+	// it is registered, they are released when it is deregistered.
+	registered := false
 	defer func() {
-		// Invoke DISCONNECT handler.
-		if err := a.invokeHandler(connID, "DISCONNECT", "", r.Header); err != nil {
-			log.Println("handler:", err)
+		if !registered {
+			a.releaseIP(peerIP)
 		}
 	}()
 
-	// Register a hook for writing back to the connection, indexed by its connection ID.
-	a.writersMu.Lock()
-	if a.writers == nil {
-		a.writers = make(map[string]io.Writer)
+	ip := sourceIP(r)
+
+	// The CONNECT handler runs before the upgrade, so only handshakes that the upgrader accepts may
+	// proceed. Otherwise the handler would see CONNECT for a connection that never opens.
+	if status := checkHandshake(w, r, upgrader.CheckOrigin); status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	for _, header := range a.RequiredHeaders {
+		if r.Header.Get(header) == "" {
+			a.logger().Warn("missing required header", "sourceIP", ip, "header", header)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
 	}
-	a.writers[connID] = &wsTextWriter{ws: ws}
-	a.writersMu.Unlock()
 
+	connID, err := a.acquireConnectionID()
+	if err == errTooManyConnections {
+		a.logger().Warn("too many connections", "sourceIP", ip)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	if err == errDuplicateConnectionID {
+		a.logger().Warn("duplicate connection ID", "sourceIP", ip)
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		a.logger().Error("generate connection ID", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
 	defer func() {
-		a.writersMu.Lock()
-		delete(a.writers, connID)
-		a.writersMu.Unlock()
+		if !registered {
+			a.releaseConnectionID(connID)
+		}
 	}()
 
-	// Read from the connection as long as it stays open.
-	for {
-		// Read the next message.
-		mt, message, err := ws.ReadMessage()
-		if err != nil {
-			log.Println("read:", err)
-			break
-		}
+	if callback := connid.Callback(r.Context()); callback != nil {
+		callback(connID)
+	}
 
-		// API Gateway Websockets only support text message types.
-		if mt != websocket.TextMessage {
-			log.Println("unsupported message type:", mt)
-			break
+	conn := &connection{
+		id:          connID,
+		header:      r.Header,
+		tls:         r.TLS,
+		trace:       a.traceHeaders(r),
+		sourceIP:    ip,
+		userAgent:   r.UserAgent(),
+		domainName:  a.domainName(r),
+		query:       r.URL.Query(),
+		connectedAt: time.Now(),
+		done:        make(chan struct{}),
+	}
+	conn.ctx, conn.cancel = context.WithCancel(r.Context())
+	defer conn.cancel()
+	conn.stats.Extensions = a.negotiatedExtensions(r)
+	conn.subprotocol = a.negotiatedSubprotocol(r)
+	conn.stats.LastActiveAt = conn.connectedAt
+
+	// Invoke CONNECT handler. Like API Gateway, refuse the handshake if it fails, with the status
+	// code and headers of the handler's response if it has a status code other than 2xx.
+	if err := a.invokeHandler(r.Context(), conn, EventTypeConnect, "", false); err != nil {
+		a.logger().Error("handler", "connectionID", conn.id, "eventType", EventTypeConnect, "err", err)
+		status := http.StatusInternalServerError
+		var statusErr *statusError
+		if errors.As(err, &statusErr) && statusErr.code >= 300 && statusErr.code <= 599 {
+			status = statusErr.code
+
+			// Pass on the handler's response headers, such as the Location of a redirect.
+			for key, value := range statusErr.headers {
+				w.Header().Set(key, value)
+			}
+			for key, values := range statusErr.multiValueHeaders {
+				for _, value := range values {
+					w.Header().Add(key, value)
+				}
+			}
 		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	// Upgrade the HTTP request to WS. If that still fails, e.g. because the client went away, the
+	// handler gets a DISCONNECT for the CONNECT that it has seen.
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		a.logger().Error("upgrade", "connectionID", conn.id, "err", err)
+		a.disconnect(r, conn, closeStatus{reason: DisconnectError, code: websocket.CloseAbnormalClosure})
+		return
+	}
+	defer ws.Close()
 
-		// Invoke the Lambda handler
-		if err := a.invokeHandler(connID, "MESSAGE", string(message), r.Header); err != nil {
-			log.Println("handler:", err)
-			if err := writeError(ws); err != nil {
-				log.Println("write:", err)
-				break
+	conn.ws = ws
+	conn.stats.ProtocolVersion = ws.Subprotocol()
+
+	if a.MaxMessageSize > 0 {
+		// Gorilla's read limit always closes the connection with 1009.
+		code := a.MessageTooBigCloseCode
+		if a.MessageTooBigCloseCodeFunc != nil {
+			if c := a.MessageTooBigCloseCodeFunc(conn.id, r); c != 0 {
+				code = c
 			}
 		}
+		if code == 0 || code == websocket.CloseMessageTooBig {
+			ws.SetReadLimit(a.MaxMessageSize)
+		} else {
+			conn.tooBigCode = code
+		}
 	}
-}
 
-func (a *Adapter) invokeHandler(connID, eventType, body string, header http.Header) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
-	defer cancel()
+	if a.CompressionLevelFunc != nil {
+		if err := ws.SetCompressionLevel(a.CompressionLevelFunc(conn.id, r)); err != nil {
+			a.logger().Warn("set compression level", "connectionID", conn.id, "err", err)
+		}
+	}
 
-	res, err := a.LambdaHandler(ctx, events.APIGatewayWebsocketProxyRequest{
-		RequestContext: events.APIGatewayWebsocketProxyRequestContext{
-			ConnectionID: connID,
-			EventType:    eventType,
-		},
-		MultiValueHeaders: header,
-		Body:              body,
-	})
+	var status closeStatus
 
-	if err != nil {
-		return err
+	defer func() {
+		if a.OnDisconnect != nil {
+			a.OnDisconnect(conn.id, status.code, status.text)
+		}
+
+		a.disconnect(r, conn, status)
+	}()
+
+	// Register the connection for writing back to it, indexed by its connection ID.
+	a.connsMu.Lock()
+	if a.conns == nil {
+		a.conns = make(map[string]*connection)
 	}
+	a.conns[conn.id] = conn
+	registered = true
+	a.countTotals(func(totals *Stats) { totals.TotalConnections++ })
+	shuttingDown := a.shuttingDown
+	a.connsMu.Unlock()
 
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("status code: %d", res.StatusCode)
+	// Shutdown began during the handshake, after it closed the connections that it knew about.
+	if shuttingDown {
+		a.startClose(conn, websocket.CloseGoingAway, "", DisconnectShutdown)
 	}
 
-	return nil
+	defer func() {
+		conn.runCloseCallbacks(status.detail)
+	}()
+
+	// Deregister the connection as soon as it stops being read. This runs before the DISCONNECT
+	// handler, so that writes to the connection from within that handler deterministically fail
+	// with a GoneException, like in API Gateway, rather than racing with the closing socket. Closing
+	// done under dispatchMu waits for a message that is being handled, and keeps injected or
+	// replayed messages from being handled after the DISCONNECT handler starts.
+	defer func() {
+		a.connsMu.Lock()
+		if a.conns[conn.id] == conn {
+			delete(a.conns, conn.id)
+		}
+		if conn.shed {
+			a.shedding--
+		}
+		a.releaseConnectionIDLocked(conn.id)
+		a.releaseIPLocked(peerIP)
+		a.connsMu.Unlock()
+		conn.cancel()
+		conn.dispatchMu.Lock()
+		close(conn.done)
+		conn.dispatchMu.Unlock()
+	}()
+
+	if a.RequireReady {
+		go a.replayWhenReady(conn)
+	}
+
+	if a.HeartbeatInterval > 0 {
+		go a.sendHeartbeats(conn)
+	}
+
+	if a.PingInterval > 0 {
+		a.keepAlive(conn)
+	}
+
+	if a.IdleTimeout > 0 {
+		conn.idle = time.AfterFunc(a.IdleTimeout, func() {
+			a.startClose(conn, websocket.CloseNormalClosure, "idle timeout", DisconnectIdleTimeout)
+		})
+		defer conn.idle.Stop()
+	}
+
+	if a.Metrics != nil {
+		a.Metrics.ObserveUpgradeDuration(time.Since(start))
+	}
+
+	if a.OnConnect != nil {
+		a.OnConnect(conn.id)
+	}
+
+	status = a.readMessages(conn)
 }
 
-func writeError(ws *websocket.Conn) error {
-	return ws.WriteMessage(websocket.TextMessage, []byte(`{"message": "Internal server error"}`))
+// checkHandshake checks the handshake of r as the upgrader does, and returns the status code with
+// which the upgrader would refuse it, or zero if it would not.
+func checkHandshake(w http.ResponseWriter, r *http.Request, checkOrigin func(*http.Request) bool) int {
+	if !websocket.IsWebSocketUpgrade(r) {
+		return http.StatusBadRequest
+	}
+	if r.Method != http.MethodGet {
+		return http.StatusMethodNotAllowed
+	}
+	if !headerContainsToken(r.Header, "Sec-Websocket-Version", "13") {
+		// Tell the client which version to use instead, as the upgrader does.
+		w.Header().Set("Sec-Websocket-Version", "13")
+		return http.StatusBadRequest
+	}
+	if !checkOrigin(r) {
+		return http.StatusForbidden
+	}
+	if r.Header.Get("Sec-Websocket-Key") == "" {
+		return http.StatusBadRequest
+	}
+	if _, ok := w.(http.Hijacker); !ok {
+		return http.StatusInternalServerError
+	}
+
+	return 0
 }
 
-func (a *Adapter) DeleteConnection(_ *apigatewaymanagementapi.DeleteConnectionInput) (*apigatewaymanagementapi.DeleteConnectionOutput, error) {
-	panic("not implemented")
+// headerContainsToken reports whether the comma-separated list of the header contains token, in
+// any case.
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
 }
 
-func (a *Adapter) DeleteConnectionWithContext(_ aws.Context, _ *apigatewaymanagementapi.DeleteConnectionInput, _ ...request.Option) (*apigatewaymanagementapi.DeleteConnectionOutput, error) {
-	panic("not implemented")
+// disconnect invokes the DISCONNECT handler of the connection, which closed with status, unless
+// the circuit skips it.
+func (a *Adapter) disconnect(r *http.Request, conn *connection, status closeStatus) {
+	if a.CircuitSkipsDisconnect && a.isCircuitOpen() {
+		return
+	}
+
+	if status.reason == DisconnectShutdown && a.OnShutdownDisconnect != nil {
+		a.connsMu.Lock()
+		a.shutdownConnIDs = append(a.shutdownConnIDs, conn.id)
+		a.connsMu.Unlock()
+		return
+	}
+
+	// The DISCONNECT handler keeps the values of the upgrade request's context but not its
+	// cancellation, since the request is over by the time that the handler runs, at least with
+	// AsyncDisconnect. It gets a fresh invocation timeout instead.
+	ctx := context.WithValue(valuesOnly{r.Context()}, disconnectReasonKey, status.reason)
+	ctx = context.WithValue(ctx, disconnectStatusKey, disconnectStatus{status.code, status.text})
+
+	if a.AsyncDisconnect {
+		a.invokeDisconnectAsync(ctx, conn)
+	} else {
+		a.invokeDisconnect(ctx, conn)
+	}
 }
 
-func (a *Adapter) DeleteConnectionRequest(_ *apigatewaymanagementapi.DeleteConnectionInput) (*request.Request, *apigatewaymanagementapi.DeleteConnectionOutput) {
-	panic("not implemented")
+// writeBufferPool returns the pool of write buffers of the given size.
+func (a *Adapter) writeBufferPool(size int) *sync.Pool {
+	a.writeBufferPoolsMu.Lock()
+	defer a.writeBufferPoolsMu.Unlock()
+
+	pool, ok := a.writeBufferPools[size]
+	if !ok {
+		if a.writeBufferPools == nil {
+			a.writeBufferPools = make(map[int]*sync.Pool)
+		}
+		pool = &sync.Pool{}
+		a.writeBufferPools[size] = pool
+	}
+
+	return pool
 }
 
-func (a *Adapter) GetConnection(_ *apigatewaymanagementapi.GetConnectionInput) (*apigatewaymanagementapi.GetConnectionOutput, error) {
-	panic("not implemented")
+// observedPool is a write buffer pool that reports its hits and misses to WriteBufferPoolMetrics.
+type observedPool struct {
+	websocket.BufferPool
+	metrics WriteBufferPoolMetrics
 }
 
-func (a *Adapter) GetConnectionWithContext(_ aws.Context, _ *apigatewaymanagementapi.GetConnectionInput, _ ...request.Option) (*apigatewaymanagementapi.GetConnectionOutput, error) {
-	panic("not implemented")
+func (p observedPool) Get() interface{} {
+	buf := p.BufferPool.Get()
+	p.metrics.ObserveWriteBufferGet(buf != nil)
+	return buf
 }
 
-func (a *Adapter) GetConnectionRequest(_ *apigatewaymanagementapi.GetConnectionInput) (*request.Request, *apigatewaymanagementapi.GetConnectionOutput) {
-	panic("not implemented")
+// closeStatus describes why a connection closed.
+type closeStatus struct {
+	reason DisconnectReason
+
+	// code and text are the close code and reason of the close frame that ended the connection,
+	// or websocket.CloseAbnormalClosure and an empty text if there was none.
+	code int
+	text string
+
+	// detail is a human-readable description of the closure.
+	detail string
 }
 
-func (a *Adapter) PostToConnection(input *apigatewaymanagementapi.PostToConnectionInput) (*apigatewaymanagementapi.PostToConnectionOutput, error) {
-	return a.PostToConnectionWithContext(context.Background(), input)
+// beginServe tracks a new ServeHTTP call for Shutdown, reporting false if the adapter is shutting
+// down.
+func (a *Adapter) beginServe() bool {
+	a.connsMu.Lock()
+	defer a.connsMu.Unlock()
+
+	if a.shuttingDown {
+		return false
+	}
+
+	a.serving.Add(1)
+
+	return true
 }
 
-func (a *Adapter) PostToConnectionWithContext(_ aws.Context, input *apigatewaymanagementapi.PostToConnectionInput, _ ...request.Option) (*apigatewaymanagementapi.PostToConnectionOutput, error) {
-	var writer io.Writer
+// Shutdown gracefully shuts down the adapter. It refuses new connections with 503 Service
+// Unavailable, closes every open connection with 1001 (going away), and waits for all of them to
+// close and for their DISCONNECT handlers or OnShutdownDisconnect to return, or for ctx to be done,
+// in which case it returns the context's error. The adapter cannot be used again after Shutdown.
+//
+// Shutdown does not stop the http.Server that serves the adapter.
+func (a *Adapter) Shutdown(ctx context.Context) error {
+	a.connsMu.Lock()
+	a.shuttingDown = true
+	conns := a.connectionsLocked()
+	a.connsMu.Unlock()
 
-	a.writersMu.Lock()
-	if a.writers != nil {
-		writer = a.writers[*input.ConnectionId]
+	for _, conn := range conns {
+		a.startClose(conn, websocket.CloseGoingAway, "", DisconnectShutdown)
 	}
-	a.writersMu.Unlock()
 
-	if writer == nil {
-		return nil, &apigatewaymanagementapi.GoneException{}
+	// The ServeHTTP calls start any asynchronous DISCONNECT handlers, so they must return first.
+	drained := make(chan struct{})
+	go func() {
+		a.serving.Wait()
+		a.disconnects.Wait()
+
+		a.connsMu.Lock()
+		connIDs := a.shutdownConnIDs
+		a.shutdownConnIDs = nil
+		a.connsMu.Unlock()
+
+		if len(connIDs) > 0 {
+			a.OnShutdownDisconnect(connIDs)
+		}
+
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	_, err := writer.Write(input.Data)
-	return &apigatewaymanagementapi.PostToConnectionOutput{}, err
+// IsShuttingDown reports whether Shutdown has been called. Handlers can also learn it with
+// ShuttingDownFromContext.
+func (a *Adapter) IsShuttingDown() bool {
+	a.connsMu.Lock()
+	defer a.connsMu.Unlock()
+
+	return a.shuttingDown
 }
 
-func (a *Adapter) PostToConnectionRequest(_ *apigatewaymanagementapi.PostToConnectionInput) (*request.Request, *apigatewaymanagementapi.PostToConnectionOutput) {
-	panic("not implemented")
+// invokeDisconnect invokes the DISCONNECT handler of the connection.
+func (a *Adapter) invokeDisconnect(ctx context.Context, conn *connection) {
+	if err := a.invokeHandler(ctx, conn, EventTypeDisconnect, "", false); err != nil {
+		a.logger().Error("handler", "connectionID", conn.id, "eventType", EventTypeDisconnect, "err", err)
+	}
 }
 
-type wsTextWriter struct {
-	ws *websocket.Conn
+// invokeDisconnectAsync invokes the DISCONNECT handler of the connection in the background,
+// limited by AsyncDisconnectWorkers.
+func (a *Adapter) invokeDisconnectAsync(ctx context.Context, conn *connection) {
+	a.disconnectSemOnce.Do(func() {
+		workers := a.AsyncDisconnectWorkers
+		if workers <= 0 {
+			workers = defaultAsyncDisconnectWorkers
+		}
+		a.disconnectSem = make(chan struct{}, workers)
+	})
+
+	a.disconnects.Add(1)
+	go func() {
+		defer a.disconnects.Done()
+
+		a.disconnectSem <- struct{}{}
+		defer func() { <-a.disconnectSem }()
+
+		a.invokeDisconnect(ctx, conn)
+	}()
 }
 
-func (w *wsTextWriter) Write(p []byte) (n int, err error) {
-	return len(p), w.ws.WriteMessage(websocket.TextMessage, p)
+// readMessages reads and handles messages from the connection as long as it stays open, and
+// returns why it closed.
+func (a *Adapter) readMessages(conn *connection) closeStatus {
+	for received := 0; ; received++ {
+		if a.YieldEvery > 0 && received > 0 && received%a.YieldEvery == 0 {
+			runtime.Gosched()
+		}
+
+		// Read the next message.
+		mt, message, err := a.readMessage(conn)
+		if err == errMessageTooBig {
+			a.logger().Warn("message too big", "connectionID", conn.id)
+			a.startClose(conn, conn.tooBigCode, "message too big", DisconnectError)
+			continue
+		}
+		if err != nil {
+			if reason, code, text, ok := conn.closeReason(); ok {
+				return closeStatus{reason: reason, code: code, text: text, detail: text}
+			}
+			a.logger().Info("read", "connectionID", conn.id, "err", err)
+			if err == websocket.ErrReadLimit {
+				// Gorilla has already sent the client a close frame with this code.
+				return closeStatus{reason: DisconnectError, code: websocket.CloseMessageTooBig, detail: err.Error()}
+			}
+			if closeErr, ok := err.(*websocket.CloseError); ok {
+				return closeStatus{
+					reason: DisconnectClientInitiated,
+					code:   closeErr.Code,
+					text:   closeErr.Text,
+					detail: err.Error(),
+				}
+			}
+			return closeStatus{reason: DisconnectError, code: websocket.CloseAbnormalClosure, detail: err.Error()}
+		}
+
+		// Discard messages that arrive while the server is closing the connection.
+		if _, _, _, ok := conn.closeReason(); ok {
+			continue
+		}
+
+		conn.touch()
+
+		if conn.idle != nil {
+			conn.idle.Reset(a.IdleTimeout)
+		}
+
+		if a.Metrics != nil {
+			a.Metrics.ObserveInboundSize(len(message))
+		}
+
+		// API Gateway Websockets only support text message types.
+		if mt != websocket.TextMessage && !(a.AllowBinaryMessages && mt == websocket.BinaryMessage) {
+			a.logger().Warn("unsupported message type", "connectionID", conn.id, "messageType", mt)
+			a.startClose(conn, websocket.CloseUnsupportedData, "unsupported message type", DisconnectError)
+			continue
+		}
+
+		if err := a.dispatchFrame(conn, frame{data: message, binary: mt == websocket.BinaryMessage}); err != nil {
+			if errors.Is(err, ErrFatal) {
+				a.startClose(conn, websocket.CloseInternalServerErr, "internal server error", DisconnectError)
+				continue
+			}
+			a.logger().Error("write", "connectionID", conn.id, "err", err)
+			return closeStatus{reason: DisconnectError, code: websocket.CloseAbnormalClosure, detail: err.Error()}
+		}
+	}
+}
+
+// errMessageTooBig is returned by readMessage for a message that exceeds MaxMessageSize.
+var errMessageTooBig = errors.New("message too big")
+
+// readMessage reads the next message from the connection. If the connection has a custom
+// MessageTooBigCloseCode, it enforces MaxMessageSize rather than gorilla, reading no more of a
+// larger message than that. Gorilla discards the rest of it with the next read.
+func (a *Adapter) readMessage(conn *connection) (int, []byte, error) {
+	if conn.tooBigCode == 0 {
+		return conn.ws.ReadMessage()
+	}
+
+	mt, r, err := conn.ws.NextReader()
+	if err != nil {
+		return mt, nil, err
+	}
+
+	message, err := ioutil.ReadAll(io.LimitReader(r, a.MaxMessageSize+1))
+	if err != nil {
+		return mt, nil, err
+	}
+	if int64(len(message)) > a.MaxMessageSize {
+		return mt, nil, errMessageTooBig
+	}
+
+	return mt, message, nil
+}
+
+// frame is a message frame received on a connection.
+type frame struct {
+	data   []byte
+	binary bool
+}
+
+// dispatchFrame authenticates the connection with a frame received on it, handles the frame, or
+// queues it if the adapter is not ready yet.
+func (a *Adapter) dispatchFrame(conn *connection, f frame) error {
+	conn.dispatchMu.Lock()
+	defer conn.dispatchMu.Unlock()
+
+	// An injected message may have waited for the connection to close.
+	if conn.isDone() {
+		return &apigatewaymanagementapi.GoneException{}
+	}
+
+	if a.authenticateFirstMessage(conn, f.data) {
+		return nil
+	}
+
+	if a.RequireReady && !a.isReady() {
+		limit := a.ReadyBufferSize
+		if limit <= 0 {
+			limit = defaultReadyBufferSize
+		}
+
+		if len(conn.pending) >= limit {
+			a.logger().Warn("ready buffer full, dropping message", "connectionID", conn.id)
+			return a.writeError(conn, a.messageID(f.data), errReadyBufferFull)
+		}
+
+		conn.pending = append(conn.pending, f)
+		return nil
+	}
+
+	if err := a.flushPending(conn); err != nil {
+		return err
+	}
+
+	return a.handleFrame(conn, f)
+}
+
+// authenticateFirstMessage passes the message to FirstMessageAuth if the connection has not
+// authenticated yet, and reports whether it did. The connection is closed if authentication fails.
+// The caller must hold conn.dispatchMu.
+func (a *Adapter) authenticateFirstMessage(conn *connection, message []byte) bool {
+	if a.FirstMessageAuth == nil || conn.isAuthenticated() {
+		return false
+	}
+
+	authorizer, err := a.FirstMessageAuth(conn.id, message)
+	if err != nil {
+		a.logger().Warn("first message auth", "connectionID", conn.id, "err", err)
+		a.startClose(conn, websocket.ClosePolicyViolation, "unauthorized", DisconnectError)
+		return true
+	}
+
+	conn.authenticate(authorizer)
+	return true
+}
+
+// flushPending handles the frames that were queued while the adapter was not ready. The caller
+// must hold conn.dispatchMu.
+func (a *Adapter) flushPending(conn *connection) error {
+	for len(conn.pending) > 0 {
+		f := conn.pending[0]
+		conn.pending = conn.pending[1:]
+
+		if err := a.handleFrame(conn, f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replayWhenReady waits until the adapter is ready and then handles the frames that were queued on
+// the connection in the meantime, so that they are not held back until the next message arrives.
+func (a *Adapter) replayWhenReady(conn *connection) {
+	select {
+	case <-a.readyChan():
+	case <-conn.done:
+		return
+	}
+
+	conn.dispatchMu.Lock()
+	defer conn.dispatchMu.Unlock()
+
+	if conn.isDone() {
+		return
+	}
+
+	if err := a.flushPending(conn); err != nil {
+		a.logger().Error("replay", "connectionID", conn.id, "err", err)
+		conn.ws.Close()
+	}
+}
+
+// sendHeartbeats writes HeartbeatMessage, or a ping if it is nil, to the connection every
+// HeartbeatInterval until it closes.
+func (a *Adapter) sendHeartbeats(conn *connection) {
+	ticker := time.NewTicker(a.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			var err error
+			if a.HeartbeatMessage == nil {
+				err = conn.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(a.HeartbeatInterval))
+			} else {
+				err = a.write(conn, a.HeartbeatMessage)
+			}
+			if err == websocket.ErrCloseSent {
+				return
+			}
+			if err != nil {
+				a.logger().Error("heartbeat", "connectionID", conn.id, "err", err)
+				return
+			}
+		case <-conn.done:
+			return
+		}
+	}
+}
+
+// keepAlive pings the connection every PingInterval until it closes, and fails reads from it if it
+// stops answering with pongs.
+func (a *Adapter) keepAlive(conn *connection) {
+	pongWait := 2 * a.PingInterval
+
+	conn.extendReadDeadline(time.Now().Add(pongWait))
+	conn.ws.SetPongHandler(func(string) error {
+		conn.extendReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	go func() {
+		ticker := time.NewTicker(a.PingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := conn.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(a.PingInterval))
+				if err != nil && err != websocket.ErrCloseSent {
+					a.logger().Warn("ping", "connectionID", conn.id, "err", err)
+				}
+			case <-conn.done:
+				return
+			}
+		}
+	}()
+}
+
+// MarkReady releases the messages held back because of RequireReady and lets later messages reach
+// the handler directly.
+func (a *Adapter) MarkReady() {
+	ready := a.readyChan()
+	a.markReadyOnce.Do(func() {
+		close(ready)
+	})
+}
+
+func (a *Adapter) readyChan() chan struct{} {
+	a.readyOnce.Do(func() {
+		a.ready = make(chan struct{})
+	})
+
+	return a.ready
+}
+
+func (a *Adapter) isReady() bool {
+	select {
+	case <-a.readyChan():
+		return true
+	default:
+		return false
+	}
+}
+
+// handleFrame handles a frame received on the connection. A text frame contains multiple messages
+// if FrameDelimiter is set.
+func (a *Adapter) handleFrame(conn *connection, f frame) error {
+	if a.FrameDelimiter == 0 || f.binary {
+		return a.handleMessage(conn, f.data, f.binary)
+	}
+
+	for _, message := range bytes.Split(f.data, []byte{a.FrameDelimiter}) {
+		if len(message) == 0 {
+			continue
+		}
+
+		if err := a.handleMessage(conn, message, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleMessage invokes the Lambda handler for a message received on the connection and replies
+// with an error message if the handler fails. An error is returned if the connection should be
+// closed, because the handler failed with ErrFatal or the reply could not be written.
+func (a *Adapter) handleMessage(conn *connection, message []byte, binary bool) error {
+	if a.isCircuitOpen() {
+		var id json.RawMessage
+		if !binary {
+			id = a.messageID(message)
+		}
+		return a.writeError(conn, id, errCircuitOpen)
+	}
+
+	if a.DecompressMessages && !binary {
+		decompressed, err := decompress(message)
+		if err != nil {
+			a.logger().Warn("decompress", "connectionID", conn.id, "err", err)
+			return a.writeError(conn, nil, errInvalidCompressedMessage)
+		}
+		message = decompressed
+	}
+
+	detectContentType := a.ContentTypeDetector
+	if detectContentType == nil {
+		detectContentType = DetectContentType
+	}
+	ctx := context.WithValue(conn.ctx, contentTypeKey, detectContentType(message))
+
+	var id json.RawMessage
+	if !binary {
+		id = a.messageID(message)
+	}
+	if id != nil {
+		ctx = context.WithValue(ctx, messageIDKey, id)
+	}
+
+	body := string(message)
+	if binary {
+		body = base64.StdEncoding.EncodeToString(message)
+	}
+
+	// Invoke the Lambda handler
+	a.countTotals(func(totals *Stats) { totals.TotalMessages++ })
+	handlerStart := time.Now()
+	err := a.invokeHandler(ctx, conn, EventTypeMessage, body, binary)
+	if a.OnMessage != nil {
+		a.OnMessage(conn.id, len(message), time.Since(handlerStart))
+	}
+	if err != nil {
+		a.logger().Error("handler", "connectionID", conn.id, "eventType", EventTypeMessage, "err", err)
+		if errors.Is(err, ErrFatal) {
+			return err
+		}
+		var statusErr *statusError
+		if a.RelayErrorBodies && errors.As(err, &statusErr) && statusErr.body != "" {
+			return a.write(conn, []byte(statusErr.body))
+		}
+		return a.writeError(conn, id, err)
+	}
+
+	return nil
+}
+
+// decompress decodes a base64-encoded gzip payload.
+func decompress(message []byte) ([]byte, error) {
+	compressed := make([]byte, base64.StdEncoding.DecodedLen(len(message)))
+	n, err := base64.StdEncoding.Decode(compressed, message)
+	if err != nil {
+		return nil, err
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(compressed[:n]))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	return ioutil.ReadAll(gz)
+}
+
+// messageID returns the raw JSON value of the message's MessageIDField, or nil if it has none.
+func (a *Adapter) messageID(message []byte) json.RawMessage {
+	if a.MessageIDField == "" {
+		return nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(message, &fields); err != nil {
+		return nil
+	}
+
+	return fields[a.MessageIDField]
+}
+
+// OpenCircuit stops invoking the handler for incoming messages, replying with an error message (see
+// CircuitOpenMessage) instead, while keeping connections open. Use it to model a circuit breaker when the handler's
+// downstream dependencies are unhealthy.
+func (a *Adapter) OpenCircuit() {
+	atomic.StoreInt32(&a.circuitOpen, 1)
+}
+
+// CloseCircuit resumes invoking the handler after OpenCircuit.
+func (a *Adapter) CloseCircuit() {
+	atomic.StoreInt32(&a.circuitOpen, 0)
+}
+
+func (a *Adapter) isCircuitOpen() bool {
+	return atomic.LoadInt32(&a.circuitOpen) == 1
+}
+
+// InjectMessage invokes the MESSAGE handler of an open connection as if the client had sent body,
+// which is useful for reproducing handler bugs deterministically. Like a received message, it goes
+// to FirstMessageAuth if the connection has not authenticated yet, is held back by RequireReady
+// and is handled after the messages that are queued before it. If the connection does not exist,
+// a *apigatewaymanagementapi.GoneException is returned. It waits for the message that the
+// connection is handling, if any, so it must not be called by a handler for the same connection.
+func (a *Adapter) InjectMessage(connID, body string) error {
+	conn := a.getConnection(connID)
+	if conn == nil {
+		return &apigatewaymanagementapi.GoneException{}
+	}
+
+	return a.dispatchFrame(conn, frame{data: []byte(body)})
+}
+
+// negotiatedSubprotocol returns the first of the Upgrader's subprotocols that the client offered
+// in r, as the upgrader selects it. The CONNECT handler runs before the upgrade, so the selection
+// is made here.
+func (a *Adapter) negotiatedSubprotocol(r *http.Request) string {
+	offered := websocket.Subprotocols(r)
+	for _, supported := range a.Upgrader.Subprotocols {
+		for _, protocol := range offered {
+			if protocol == supported {
+				return protocol
+			}
+		}
+	}
+
+	return ""
+}
+
+// negotiatedExtensions returns the websocket extensions that the upgrader agreed to for r. The
+// upgrader does not report them, so its negotiation is reproduced here.
+func (a *Adapter) negotiatedExtensions(r *http.Request) []string {
+	if !a.Upgrader.EnableCompression {
+		return nil
+	}
+
+	for _, value := range r.Header["Sec-Websocket-Extensions"] {
+		for _, ext := range strings.Split(value, ",") {
+			name := strings.TrimSpace(strings.SplitN(ext, ";", 2)[0])
+			if strings.EqualFold(name, "permessage-deflate") {
+				return []string{"permessage-deflate"}
+			}
+		}
+	}
+
+	return nil
+}
+
+// traceHeaders returns the tracing headers of r, or nil if it has none.
+func (a *Adapter) traceHeaders(r *http.Request) http.Header {
+	names := a.TraceHeaders
+	if names == nil {
+		names = []string{"traceparent", "tracestate"}
+	}
+
+	var trace http.Header
+	for _, name := range names {
+		if values := r.Header.Values(name); len(values) > 0 {
+			if trace == nil {
+				trace = make(http.Header)
+			}
+			trace[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+
+	return trace
+}
+
+// acquireIP counts a new connection from the given source IP, reporting false without counting it
+// if MaxConnectionsPerIP has been reached.
+func (a *Adapter) acquireIP(ip string) bool {
+	a.connsMu.Lock()
+	defer a.connsMu.Unlock()
+
+	if a.MaxConnectionsPerIP > 0 && a.ipConns[ip] >= a.MaxConnectionsPerIP {
+		return false
+	}
+
+	if a.ipConns == nil {
+		a.ipConns = make(map[string]int)
+	}
+	a.ipConns[ip]++
+
+	return true
+}
+
+func (a *Adapter) releaseIP(ip string) {
+	a.connsMu.Lock()
+	defer a.connsMu.Unlock()
+
+	a.releaseIPLocked(ip)
+}
+
+// releaseIPLocked uncounts a connection from the given IP address. The caller must hold connsMu.
+func (a *Adapter) releaseIPLocked(ip string) {
+	a.ipConns[ip]--
+	if a.ipConns[ip] <= 0 {
+		delete(a.ipConns, ip)
+	}
+}
+
+// errTooManyConnections is returned by acquireConnectionID if MaxConnections has been reached.
+var errTooManyConnections = errors.New("too many connections")
+
+// errDuplicateConnectionID is returned by acquireConnectionID if the generated ID belongs to
+// another connection and DuplicateConnectionPolicy does not resolve it.
+var errDuplicateConnectionID = errors.New("duplicate connection ID")
+
+// acquireConnectionID generates the ID of a new connection and reserves it until
+// releaseConnectionID, resolving duplicates according to DuplicateConnectionPolicy, and failing if
+// MaxConnections has been reached and SheddingPolicy does not make room. Reserved IDs include those
+// of connections that are still being set up, so that a burst of connections cannot exceed the
+// limit.
+func (a *Adapter) acquireConnectionID() (string, error) {
+	generate := a.ConnectionIDFunc
+	if generate == nil {
+		generate = randomID
+	}
+
+	id, err := generate()
+	if err != nil {
+		return "", err
+	}
+	id = a.ConnectionIDPrefix + id
+
+	a.connsMu.Lock()
+	id, replaced, shed, err := a.reserveConnectionIDLocked(id)
+	a.connsMu.Unlock()
+
+	// Close the connections that make room outside of the lock, since sending the close frame may
+	// block.
+	if replaced != nil {
+		a.startClose(replaced, websocket.CloseNormalClosure, "replaced", DisconnectReplaced)
+	}
+	if shed != nil {
+		code := a.ShedCloseCode
+		if code == 0 {
+			code = websocket.CloseTryAgainLater
+		}
+		a.startClose(shed, code, "", DisconnectShed)
+	}
+
+	return id, err
+}
+
+// reserveConnectionIDLocked reserves id, or the ID that DuplicateConnectionPolicy resolves it to,
+// and returns it along with the connection that it takes over and the connection that
+// SheddingPolicy closes for it, if any. Both are removed from conns, so that they are not chosen
+// again. The caller must hold connsMu.
+func (a *Adapter) reserveConnectionIDLocked(id string) (string, *connection, *connection, error) {
+	var replaced, shed *connection
+
+	if a.connIDs[id] > 0 {
+		switch a.DuplicateConnectionPolicy {
+		case DuplicateTakeover:
+			// Only an open connection can be taken over. Removing it from conns directs management
+			// API calls for the ID to the new connection once that is open.
+			replaced = a.conns[id]
+			if replaced == nil {
+				return "", nil, nil, errDuplicateConnectionID
+			}
+			delete(a.conns, id)
+		case DuplicateSuffix:
+			base := id
+			for n := 2; a.connIDs[id] > 0; n++ {
+				id = fmt.Sprintf("%s-%d", base, n)
+			}
+		default:
+			return "", nil, nil, errDuplicateConnectionID
+		}
+	}
+
+	// A connection that takes over an ID does not add to the number of connections for long.
+	if replaced == nil && a.MaxConnections > 0 && len(a.connIDs)-a.shedding >= a.MaxConnections {
+		shed = a.shedLocked()
+		if shed == nil {
+			return "", nil, nil, errTooManyConnections
+		}
+		delete(a.conns, shed.id)
+		shed.shed = true
+		a.shedding++
+	}
+
+	if a.connIDs == nil {
+		a.connIDs = make(map[string]int)
+	}
+	a.connIDs[id]++
+
+	return id, replaced, shed, nil
+}
+
+// shedLocked returns the open connection that SheddingPolicy closes to make room for a new one, or
+// nil if it closes none. The caller must hold connsMu.
+func (a *Adapter) shedLocked() *connection {
+	var (
+		shed *connection
+		key  time.Time
+	)
+	for _, conn := range a.conns {
+		var connKey time.Time
+		switch a.SheddingPolicy {
+		case ShedCloseOldest:
+			connKey = conn.connectedAt
+		case ShedCloseLeastActive:
+			conn.mu.Lock()
+			connKey = conn.stats.LastActiveAt
+			conn.mu.Unlock()
+		default:
+			return nil
+		}
+
+		if shed == nil || connKey.Before(key) {
+			shed, key = conn, connKey
+		}
+	}
+
+	return shed
+}
+
+func (a *Adapter) releaseConnectionID(id string) {
+	a.connsMu.Lock()
+	defer a.connsMu.Unlock()
+
+	a.releaseConnectionIDLocked(id)
+}
+
+// releaseConnectionIDLocked releases a connection's hold on its ID. The caller must hold connsMu.
+func (a *Adapter) releaseConnectionIDLocked(id string) {
+	a.connIDs[id]--
+	if a.connIDs[id] <= 0 {
+		delete(a.connIDs, id)
+	}
+}
+
+// randomID returns 8 random bytes, base64 encoded, like the connection and request IDs of API
+// Gateway.
+func randomID() (string, error) {
+	var src [8]byte
+	if _, err := rand.Read(src[:]); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(src[:]), nil
+}
+
+// domainName returns DomainName, or else the host and port that the client connected to, from the
+// Host header of r.
+func (a *Adapter) domainName(r *http.Request) string {
+	if a.DomainName != "" {
+		return a.DomainName
+	}
+
+	if r.Host == "" {
+		return defaultDomainName
+	}
+
+	return r.Host
+}
+
+// sourceIP returns the IP address of the client that sent r. Like API Gateway, it reports the
+// originating client's address from X-Forwarded-For if the request passed through a proxy.
+func sourceIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+
+	return remoteIP(r)
+}
+
+// remoteIP returns the IP address of the peer that sent r.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func (a *Adapter) invokeHandler(ctx context.Context, conn *connection, eventType, body string, isBase64Encoded bool) (err error) {
+	defer func() {
+		if err != nil {
+			a.countTotals(func(totals *Stats) { totals.TotalHandlerErrors++ })
+		}
+	}()
+
+	if a.MaxConcurrentInvocations > 0 {
+		a.invocationSemOnce.Do(func() {
+			a.invocationSem = make(chan struct{}, a.MaxConcurrentInvocations)
+		})
+		a.invocationSem <- struct{}{}
+		defer func() { <-a.invocationSem }()
+	}
+
+	timeout := a.InvocationTimeout
+	if timeout == 0 {
+		timeout = defaultInvocationTimeout
+	}
+
+	if eventType == EventTypeConnect {
+		connectTimeout := a.ConnectTimeout
+		if connectTimeout <= 0 {
+			connectTimeout = defaultConnectTimeout
+		}
+		if timeout < 0 || connectTimeout < timeout {
+			timeout = connectTimeout
+		}
+	}
+
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	ctx = context.WithValue(ctx, adapterKey, a)
+
+	if conn.tls != nil {
+		ctx = context.WithValue(ctx, tlsKey, conn.tls)
+	}
+
+	if conn.trace != nil {
+		ctx = context.WithValue(ctx, traceHeadersKey, conn.trace)
+	}
+
+	if conn.subprotocol != "" {
+		ctx = context.WithValue(ctx, subprotocolKey, conn.subprotocol)
+	}
+
+	requestID, err := randomID()
+	if err != nil {
+		return fmt.Errorf("generate request ID: %w", err)
+	}
+	requestTime := time.Now()
+
+	req := events.APIGatewayWebsocketProxyRequest{
+		RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+			RequestID:        requestID,
+			RequestTime:      requestTime.UTC().Format(requestTimeFormat),
+			RequestTimeEpoch: requestTime.UnixNano() / int64(time.Millisecond),
+			ConnectionID:     conn.id,
+			EventType:        eventType,
+			MessageDirection: "IN",
+			RouteKey:         a.routeKey(eventType, body),
+			DomainName:       conn.domainName,
+			Stage:            a.Stage,
+			APIID:            a.APIID,
+			Identity: events.APIGatewayRequestIdentity{
+				SourceIP:  conn.sourceIP,
+				UserAgent: conn.userAgent,
+			},
+		},
+		MultiValueHeaders: conn.header,
+		Body:              body,
+		IsBase64Encoded:   isBase64Encoded,
+	}
+
+	// Like API Gateway, only the CONNECT event carries the query string of the connection URL.
+	if eventType == EventTypeConnect && len(conn.query) > 0 {
+		req.QueryStringParameters = make(map[string]string, len(conn.query))
+		for key, values := range conn.query {
+			req.QueryStringParameters[key] = values[len(values)-1]
+		}
+		req.MultiValueQueryStringParameters = conn.query
+	}
+
+	if authorizer := conn.getAuthorizer(); authorizer != nil {
+		req.RequestContext.Authorizer = authorizer
+	}
+
+	if a.RequestInterceptor != nil {
+		a.RequestInterceptor(&req)
+	}
+
+	start := time.Now()
+
+	if a.SlowHandlerThreshold > 0 {
+		watchdog := time.AfterFunc(a.SlowHandlerThreshold, func() {
+			a.reportSlowHandler(conn.id, eventType, time.Since(start))
+		})
+		defer watchdog.Stop()
+	}
+
+	res, err := a.callHandler(ctx, req)
+	conn.recordInvocation(time.Since(start))
+
+	a.notifyObservers(ctx, timeout, req)
+
+	// A CONNECT handler that exceeds the timeout refuses the handshake with 504, also if it stopped
+	// with an error such as ctx.Err().
+	if eventType == EventTypeConnect && ctx.Err() == context.DeadlineExceeded {
+		return &statusError{code: http.StatusGatewayTimeout}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if a.ResponseInterceptor != nil {
+		a.ResponseInterceptor(eventType, conn.id, &res)
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &statusError{
+			code:              res.StatusCode,
+			body:              res.Body,
+			headers:           res.Headers,
+			multiValueHeaders: res.MultiValueHeaders,
+		}
+	}
+
+	if a.WarnOnDiscardedBody && res.Body != "" {
+		a.logger().Warn("discarded response body", "connectionID", conn.id, "eventType", eventType, "bodyLength", len(res.Body))
+	}
+
+	return nil
+}
+
+// callHandler calls the handler of the event's route.
+func (a *Adapter) callHandler(ctx context.Context, req events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	handler := a.handler(req.RequestContext.RouteKey)
+	if handler == nil {
+		if req.RequestContext.EventType != EventTypeMessage {
+			return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+		}
+		return events.APIGatewayProxyResponse{}, fmt.Errorf("no handler for route %s", req.RequestContext.RouteKey)
+	}
+
+	return a.call(ctx, handler, req)
+}
+
+// call calls handler, converting a panic into an error, so that it fails only the invocation, like
+// in Lambda.
+func (a *Adapter) call(ctx context.Context, handler LambdaHandler, req events.APIGatewayWebsocketProxyRequest) (res events.APIGatewayProxyResponse, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			a.logger().Error("handler panic",
+				"connectionID", req.RequestContext.ConnectionID,
+				"eventType", req.RequestContext.EventType,
+				"panic", p,
+				"stack", string(debug.Stack()))
+			err = fmt.Errorf("handler panic: %v", p)
+		}
+	}()
+
+	return handler(ctx, req)
+}
+
+// handler returns the handler for the given route key, or nil if there is none.
+func (a *Adapter) handler(routeKey string) LambdaHandler {
+	if handler, ok := a.Handlers[routeKey]; ok {
+		return handler
+	}
+
+	if routeKey != "$connect" && routeKey != "$disconnect" {
+		if handler, ok := a.Handlers["$default"]; ok {
+			return handler
+		}
+	}
+
+	return a.LambdaHandler
+}
+
+// statusError is returned by invokeHandler when the handler responds with a status code other
+// than 2xx, or exceeds the connect timeout.
+type statusError struct {
+	code              int
+	body              string
+	headers           map[string]string
+	multiValueHeaders map[string][]string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("status code: %d", e.code)
+}
+
+func (a *Adapter) reportSlowHandler(connID, eventType string, elapsed time.Duration) {
+	if a.OnSlowHandler != nil {
+		a.OnSlowHandler(connID, eventType, elapsed)
+		return
+	}
+
+	a.logger().Warn("slow handler", "connectionID", connID, "eventType", eventType, "elapsed", elapsed)
+}
+
+// routeKey returns the route key of an event.
+func (a *Adapter) routeKey(eventType, body string) string {
+	switch eventType {
+	case EventTypeConnect:
+		return "$connect"
+	case EventTypeDisconnect:
+		return "$disconnect"
+	}
+
+	const prefix = "$request.body."
+	if !strings.HasPrefix(a.RouteSelectionExpression, prefix) {
+		return "$default"
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(body), &value); err != nil {
+		return "$default"
+	}
+
+	// Walk the dotted path into nested objects.
+	for _, key := range strings.Split(strings.TrimPrefix(a.RouteSelectionExpression, prefix), ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "$default"
+		}
+		value = object[key]
+	}
+
+	route, _ := value.(string)
+	if route == "" {
+		return "$default"
+	}
+
+	return route
+}
+
+// AddObserver registers a handler that is invoked with every event after the primary
+// LambdaHandler, e.g. to write an audit log. Observers run concurrently in the background; their
+// responses are ignored and their errors are logged rather than returned to the client.
+func (a *Adapter) AddObserver(observer LambdaHandler) {
+	a.observersMu.Lock()
+	defer a.observersMu.Unlock()
+
+	a.observers = append(a.observers, observer)
+}
+
+// notifyObservers invokes the registered observers with req in the background. Their contexts keep
+// the values of ctx but get a fresh timeout, since ctx ends when the primary handler returns.
+func (a *Adapter) notifyObservers(ctx context.Context, timeout time.Duration, req events.APIGatewayWebsocketProxyRequest) {
+	a.observersMu.Lock()
+	observers := a.observers
+	a.observersMu.Unlock()
+
+	for _, observer := range observers {
+		go func(observer LambdaHandler) {
+			ctx, cancel := withTimeout(valuesOnly{ctx}, timeout)
+			defer cancel()
+
+			if _, err := a.call(ctx, observer, req); err != nil {
+				a.logger().Error("observer", "connectionID", req.RequestContext.ConnectionID, "eventType", req.RequestContext.EventType, "err", err)
+			}
+		}(observer)
+	}
+}
+
+// startClose begins a server-initiated close of the connection by sending a close frame with the
+// given code and text. The client is expected to respond with its own close frame, so that it
+// observes a clean RFC 6455 closure. Gorilla only completes the handshake while the connection is
+// being read, so the read loop keeps running, discarding messages, until the client responds or
+// CloseHandshakeTimeout elapses. The DISCONNECT handler then fires with the given reason.
+//
+// It is safe to call from any goroutine. Only the first call for a connection has an effect.
+func (a *Adapter) startClose(conn *connection, code int, text string, reason DisconnectReason) {
+	if !conn.markClosing(reason, code, text) {
+		return
+	}
+
+	conn.cancel()
+
+	timeout := a.CloseHandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultCloseHandshakeTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	if err := conn.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), deadline); err != nil {
+		// ErrCloseSent means that the connection is already closing, which is benign here.
+		if err != websocket.ErrCloseSent {
+			a.logger().Error("write close", "connectionID", conn.id, "err", err)
+		}
+	}
+
+	// Setting a deadline only fails once the underlying connection is closed, which is the outcome
+	// the handshake is waiting for anyway.
+	_ = conn.ws.SetReadDeadline(deadline)
+}
+
+var (
+	// errReadyBufferFull is passed to ErrorResponseFunc for messages dropped because of RequireReady.
+	errReadyBufferFull = errors.New("ready buffer full")
+
+	// errCircuitOpen is passed to ErrorResponseFunc for messages received while the circuit is open.
+	errCircuitOpen = errors.New("circuit open")
+
+	// errInvalidCompressedMessage is passed to ErrorResponseFunc for messages that
+	// DecompressMessages cannot decompress.
+	errInvalidCompressedMessage = errors.New("invalid compressed message")
+)
+
+// writeError tells the client that its message with the given ID, which may be nil, could not be
+// handled because of err.
+func (a *Adapter) writeError(conn *connection, id json.RawMessage, err error) error {
+	if err == errCircuitOpen && a.CircuitOpenMessage != nil {
+		return a.write(conn, a.CircuitOpenMessage)
+	}
+
+	if a.ErrorResponseFunc != nil {
+		return a.write(conn, a.ErrorResponseFunc(id, err))
+	}
+
+	message := "Internal server error"
+	switch err {
+	case errCircuitOpen:
+		message = "Service unavailable"
+	case errInvalidCompressedMessage:
+		message = "Invalid compressed message"
+	}
+
+	if id == nil {
+		return a.write(conn, []byte(`{"message": "`+message+`"}`))
+	}
+
+	reply, err := json.Marshal(struct {
+		Message string          `json:"message"`
+		ID      json.RawMessage `json:"id"`
+	}{message, id})
+	if err != nil {
+		return err
+	}
+
+	return a.write(conn, reply)
+}
+
+// write sends a text message to the connection, unless OutboundFilter drops it, after any simulated
+// outbound latency.
+func (a *Adapter) write(conn *connection, p []byte) error {
+	_, err := a.writeMessage(conn, websocket.TextMessage, p)
+	return err
+}
+
+// writeMessage is like write, for a message of the given type. It reports whether the message was
+// written, which it is not if OutboundFilter drops it.
+func (a *Adapter) writeMessage(conn *connection, messageType int, p []byte) (bool, error) {
+	if a.OutboundFilter != nil && !a.OutboundFilter(conn.id, p) {
+		return false, nil
+	}
+
+	delay := a.OutboundLatency
+	if a.OutboundJitter > 0 {
+		delay += time.Duration(mathrand.Int63n(int64(a.OutboundJitter)))
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	if a.Metrics != nil {
+		a.Metrics.ObserveOutboundSize(len(p))
+	}
+
+	err := conn.write(messageType, p, a.WriteTimeout)
+	if err != nil {
+		// The connection cannot be written to anymore, so handlers may as well stop.
+		conn.cancel()
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		// Gorilla fails all further writes after one fails, so the connection is unusable.
+		a.logger().Warn("write timeout", "connectionID", conn.id)
+		conn.ws.Close()
+	}
+	return err == nil, err
+}
+
+// recordInvocation updates the connection's handler duration statistics.
+func (c *connection) recordInvocation(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.Invocations++
+	c.totalDuration += d
+	c.stats.LastHandlerDuration = d
+	c.stats.AvgHandlerDuration = c.totalDuration / time.Duration(c.stats.Invocations)
+	if d > c.stats.MaxHandlerDuration {
+		c.stats.MaxHandlerDuration = d
+	}
+}
+
+// isDone reports whether the connection has closed.
+func (c *connection) isDone() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// touch records that a message was received on the connection.
+func (c *connection) touch() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.LastActiveAt = time.Now()
+}
+
+// extendReadDeadline sets the read deadline of the connection, unless the server is closing it,
+// in which case the close handshake deadline stays in effect.
+func (c *connection) extendReadDeadline(deadline time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closing {
+		_ = c.ws.SetReadDeadline(deadline)
+	}
+}
+
+// markClosing records that the server is closing the connection, reporting false if it already
+// was.
+func (c *connection) markClosing(reason DisconnectReason, code int, text string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return false
+	}
+
+	c.closing = true
+	c.closingReason = reason
+	c.closingCode = code
+	c.closingReasonMsg = text
+
+	return true
+}
+
+// closeReason returns the reason, close code and close text with which the server is closing the
+// connection, if it is.
+func (c *connection) closeReason() (DisconnectReason, int, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closingReason, c.closingCode, c.closingReasonMsg, c.closing
+}
+
+// runCloseCallbacks marks the connection as closed and runs the callbacks registered with
+// Adapter.OnConnectionClose.
+func (c *connection) runCloseCallbacks(reason string) {
+	c.mu.Lock()
+	callbacks := c.onClose
+	c.onClose = nil
+	c.closed = true
+	c.mu.Unlock()
+
+	for _, fn := range callbacks {
+		fn(reason)
+	}
+}
+
+// authenticate marks the connection as authenticated by FirstMessageAuth.
+func (c *connection) authenticate(authorizer map[string]interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.authorizer = authorizer
+	c.authenticated = true
+}
+
+func (c *connection) isAuthenticated() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.authenticated
+}
+
+func (c *connection) getAuthorizer() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.authorizer
+}
+
+// OnConnectionClose registers a callback that is called once, with a description of the reason,
+// when the given connection closes. It runs after the connection has been deregistered and before
+// the DISCONNECT handler is invoked. If the connection does not exist, a
+// *apigatewaymanagementapi.GoneException is returned.
+func (a *Adapter) OnConnectionClose(connID string, fn func(reason string)) error {
+	conn := a.getConnection(connID)
+	if conn == nil {
+		return &apigatewaymanagementapi.GoneException{}
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.closed {
+		return &apigatewaymanagementapi.GoneException{}
+	}
+
+	conn.onClose = append(conn.onClose, fn)
+
+	return nil
+}
+
+// SetProtocolVersion records the application protocol version used by an open connection, as
+// reported by ConnectionStats. If the connection does not exist, a
+// *apigatewaymanagementapi.GoneException is returned.
+func (a *Adapter) SetProtocolVersion(connID, version string) error {
+	conn := a.getConnection(connID)
+	if conn == nil {
+		return &apigatewaymanagementapi.GoneException{}
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	conn.stats.ProtocolVersion = version
+
+	return nil
+}
+
+// ConnectionStats returns a snapshot of the statistics of an open connection. If the connection
+// does not exist, a *apigatewaymanagementapi.GoneException is returned.
+func (a *Adapter) ConnectionStats(connID string) (ConnectionStats, error) {
+	conn := a.getConnection(connID)
+	if conn == nil {
+		return ConnectionStats{}, &apigatewaymanagementapi.GoneException{}
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	return conn.stats, nil
+}
+
+// Stats holds statistics about all connections of an Adapter.
+type Stats struct {
+	// ActiveConnections is the number of open connections.
+	ActiveConnections int
+
+	// TotalConnections is the number of connections opened so far, not counting connections that
+	// the CONNECT handler refused.
+	TotalConnections uint64
+
+	// TotalMessages is the number of messages handled so far.
+	TotalMessages uint64
+
+	// TotalHandlerErrors is the number of handler invocations for any event that failed so far,
+	// either with an error or with a status code other than 2xx.
+	TotalHandlerErrors uint64
+}
+
+// Stats returns a snapshot of the statistics of all connections.
+func (a *Adapter) Stats() Stats {
+	a.totalsMu.Lock()
+	stats := a.totals
+	a.totalsMu.Unlock()
+
+	a.connsMu.Lock()
+	stats.ActiveConnections = len(a.conns)
+	a.connsMu.Unlock()
+
+	return stats
+}
+
+// countTotals updates the counters of Stats.
+func (a *Adapter) countTotals(update func(totals *Stats)) {
+	a.totalsMu.Lock()
+	defer a.totalsMu.Unlock()
+
+	update(&a.totals)
+}
+
+// connectionsLocked returns all open connections. The caller must hold connsMu.
+func (a *Adapter) connectionsLocked() []*connection {
+	conns := make([]*connection, 0, len(a.conns))
+	for _, conn := range a.conns {
+		conns = append(conns, conn)
+	}
+
+	return conns
+}
+
+// ConnectionIDs returns the IDs of all open connections, in no particular order.
+func (a *Adapter) ConnectionIDs() []string {
+	a.connsMu.Lock()
+	defer a.connsMu.Unlock()
+
+	ids := make([]string, 0, len(a.conns))
+	for id := range a.conns {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// Broadcast writes data to every open connection, like PostToConnection, and returns the number of
+// connections that it was written to. The connections are written to concurrently, so that they
+// only wait for their own OutboundLatency. Connections that close during the broadcast and messages
+// that OutboundFilter drops are not counted. If writing to any other connection fails, the
+// broadcast continues and a *BroadcastError is returned.
+func (a *Adapter) Broadcast(data []byte) (sent int, err error) {
+	a.connsMu.Lock()
+	conns := a.connectionsLocked()
+	a.connsMu.Unlock()
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs map[string]error
+	)
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *connection) {
+			defer wg.Done()
+
+			written, err := a.writeMessage(conn, websocket.TextMessage, data)
+			if err != nil {
+				a.undeliverable(conn.id, data, err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch {
+			case written:
+				sent++
+			case err != nil && !conn.isDone():
+				if errs == nil {
+					errs = make(map[string]error)
+				}
+				errs[conn.id] = err
+			}
+		}(conn)
+	}
+	wg.Wait()
+
+	if errs != nil {
+		return sent, &BroadcastError{Errors: errs}
+	}
+
+	return sent, nil
+}
+
+// BroadcastError is returned by Broadcast if writing to any connection failed.
+type BroadcastError struct {
+	// Errors maps the IDs of the connections that could not be written to to their errors.
+	Errors map[string]error
+}
+
+func (e *BroadcastError) Error() string {
+	return fmt.Sprintf("broadcast failed for %d connections", len(e.Errors))
+}
+
+// isForeign reports whether the connection ID belongs to another adapter, by its
+// ForeignConnectionIDPrefixes.
+func (a *Adapter) isForeign(connID string) bool {
+	for _, prefix := range a.ForeignConnectionIDPrefixes {
+		if strings.HasPrefix(connID, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unknownConnectionError returns the error of a management API call for a connection that the
+// adapter does not have.
+func (a *Adapter) unknownConnectionError(connID string) error {
+	if a.isForeign(connID) {
+		return &apigatewaymanagementapi.ForbiddenException{}
+	}
+
+	return &apigatewaymanagementapi.GoneException{}
+}
+
+// getConnection returns the open connection with the given ID, or nil.
+func (a *Adapter) getConnection(connID string) *connection {
+	a.connsMu.Lock()
+	defer a.connsMu.Unlock()
+
+	return a.conns[connID]
+}
+
+func (a *Adapter) DeleteConnection(input *apigatewaymanagementapi.DeleteConnectionInput) (*apigatewaymanagementapi.DeleteConnectionOutput, error) {
+	return a.DeleteConnectionWithContext(context.Background(), input)
+}
+
+// DeleteConnectionWithContext closes the connection with a normal closure (1000). It returns once
+// the close frame is sent; the DISCONNECT handler fires when the client acknowledges it, or after
+// CloseHandshakeTimeout.
+func (a *Adapter) DeleteConnectionWithContext(ctx aws.Context, input *apigatewaymanagementapi.DeleteConnectionInput, opts ...request.Option) (*apigatewaymanagementapi.DeleteConnectionOutput, error) {
+	conn := a.getConnection(*input.ConnectionId)
+	if conn == nil && a.Fallback != nil && !a.isForeign(*input.ConnectionId) {
+		return a.Fallback.DeleteConnectionWithContext(ctx, input, opts...)
+	}
+	if conn == nil {
+		return nil, a.unknownConnectionError(*input.ConnectionId)
+	}
+
+	a.startClose(conn, websocket.CloseNormalClosure, "", DisconnectDeleted)
+
+	return &apigatewaymanagementapi.DeleteConnectionOutput{}, nil
+}
+
+// DeleteConnectionRequest returns a request whose Send method closes the connection like
+// DeleteConnectionWithContext, without making an HTTP request.
+func (a *Adapter) DeleteConnectionRequest(input *apigatewaymanagementapi.DeleteConnectionInput) (*request.Request, *apigatewaymanagementapi.DeleteConnectionOutput) {
+	output := &apigatewaymanagementapi.DeleteConnectionOutput{}
+
+	req := newRequest("DeleteConnection", http.MethodDelete, input, output, func(r *request.Request) {
+		_, r.Error = a.DeleteConnectionWithContext(r.Context(), input)
+	})
+
+	return req, output
+}
+
+func (a *Adapter) GetConnection(input *apigatewaymanagementapi.GetConnectionInput) (*apigatewaymanagementapi.GetConnectionOutput, error) {
+	return a.GetConnectionWithContext(context.Background(), input)
+}
+
+func (a *Adapter) GetConnectionWithContext(ctx aws.Context, input *apigatewaymanagementapi.GetConnectionInput, opts ...request.Option) (*apigatewaymanagementapi.GetConnectionOutput, error) {
+	conn := a.getConnection(*input.ConnectionId)
+	if conn == nil && a.Fallback != nil && !a.isForeign(*input.ConnectionId) {
+		return a.Fallback.GetConnectionWithContext(ctx, input, opts...)
+	}
+	if conn == nil {
+		return nil, a.unknownConnectionError(*input.ConnectionId)
+	}
+
+	conn.mu.Lock()
+	lastActiveAt := conn.stats.LastActiveAt
+	conn.mu.Unlock()
+
+	return &apigatewaymanagementapi.GetConnectionOutput{
+		ConnectedAt:  aws.Time(conn.connectedAt),
+		LastActiveAt: aws.Time(lastActiveAt),
+		Identity: &apigatewaymanagementapi.Identity{
+			SourceIp:  aws.String(conn.sourceIP),
+			UserAgent: aws.String(conn.userAgent),
+		},
+	}, nil
+}
+
+// GetConnectionRequest returns a request whose Send method fills in the output like
+// GetConnectionWithContext, without making an HTTP request.
+func (a *Adapter) GetConnectionRequest(input *apigatewaymanagementapi.GetConnectionInput) (*request.Request, *apigatewaymanagementapi.GetConnectionOutput) {
+	output := &apigatewaymanagementapi.GetConnectionOutput{}
+
+	req := newRequest("GetConnection", http.MethodGet, input, output, func(r *request.Request) {
+		var got *apigatewaymanagementapi.GetConnectionOutput
+		got, r.Error = a.GetConnectionWithContext(r.Context(), input)
+		if got != nil {
+			*output = *got
+		}
+	})
+
+	return req, output
+}
+
+func (a *Adapter) PostToConnection(input *apigatewaymanagementapi.PostToConnectionInput) (*apigatewaymanagementapi.PostToConnectionOutput, error) {
+	return a.PostToConnectionWithContext(context.Background(), input)
+}
+
+func (a *Adapter) PostToConnectionWithContext(ctx aws.Context, input *apigatewaymanagementapi.PostToConnectionInput, opts ...request.Option) (*apigatewaymanagementapi.PostToConnectionOutput, error) {
+	conn := a.getConnection(*input.ConnectionId)
+	if conn == nil && a.Fallback != nil && !a.isForeign(*input.ConnectionId) {
+		return a.Fallback.PostToConnectionWithContext(ctx, input, opts...)
+	}
+	if conn == nil {
+		err := a.unknownConnectionError(*input.ConnectionId)
+		a.undeliverable(*input.ConnectionId, input.Data, err)
+		return nil, err
+	}
+
+	err := a.write(conn, input.Data)
+	if err != nil {
+		a.undeliverable(conn.id, input.Data, err)
+	}
+	return &apigatewaymanagementapi.PostToConnectionOutput{}, err
+}
+
+// PostBinaryToConnection is like PostToConnection, but sends the data as a binary message, for
+// clients of adapters with AllowBinaryMessages. API Gateway cannot send binary messages, so
+// connections unknown to the adapter are not posted to Fallback.
+func (a *Adapter) PostBinaryToConnection(input *apigatewaymanagementapi.PostToConnectionInput) (*apigatewaymanagementapi.PostToConnectionOutput, error) {
+	conn := a.getConnection(*input.ConnectionId)
+	if conn == nil {
+		err := a.unknownConnectionError(*input.ConnectionId)
+		a.undeliverable(*input.ConnectionId, input.Data, err)
+		return nil, err
+	}
+
+	_, err := a.writeMessage(conn, websocket.BinaryMessage, input.Data)
+	if err != nil {
+		a.undeliverable(conn.id, input.Data, err)
+	}
+	return &apigatewaymanagementapi.PostToConnectionOutput{}, err
+}
+
+func (a *Adapter) undeliverable(connID string, data []byte, err error) {
+	if a.OnUndeliverable != nil {
+		a.OnUndeliverable(connID, data, err)
+	}
+}
+
+// PostToConnectionRequest returns a request whose Send method writes the data to the connection
+// like PostToConnectionWithContext, without making an HTTP request.
+func (a *Adapter) PostToConnectionRequest(input *apigatewaymanagementapi.PostToConnectionInput) (*request.Request, *apigatewaymanagementapi.PostToConnectionOutput) {
+	output := &apigatewaymanagementapi.PostToConnectionOutput{}
+
+	req := newRequest("PostToConnection", http.MethodPost, input, output, func(r *request.Request) {
+		_, r.Error = a.PostToConnectionWithContext(r.Context(), input)
+	})
+
+	return req, output
+}
+
+// newRequest returns a request for the management API operation with the given name and HTTP
+// method, whose Send handler is send instead of an HTTP round trip.
+func newRequest(name, method string, input, output interface{}, send func(r *request.Request)) *request.Request {
+	var handlers request.Handlers
+	handlers.Send.PushBack(send)
+
+	op := &request.Operation{
+		Name:       name,
+		HTTPMethod: method,
+		HTTPPath:   "/@connections/{connectionId}",
+	}
+	clientInfo := metadata.ClientInfo{
+		ServiceName: apigatewaymanagementapi.ServiceName,
+		ServiceID:   apigatewaymanagementapi.ServiceID,
+	}
+
+	return request.New(aws.Config{}, clientInfo, handlers, nil, op, input, output)
+}
+
+// write sends a message of the given type to the connection, within timeout if set. Gorilla
+// supports only one concurrent writer per connection, so writes are serialized. Control frames such
+// as close frames do not need the lock, because gorilla allows WriteControl concurrently with all
+// other methods.
+func (c *connection) write(messageType int, p []byte, timeout time.Duration) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if timeout > 0 {
+		if err := c.ws.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+	}
+
+	return c.ws.WriteMessage(messageType, p)
 }
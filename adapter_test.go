@@ -0,0 +1,4104 @@
+package awswebsocketadapter_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go/service/apigatewaymanagementapi/apigatewaymanagementapiiface"
+	"github.com/gorilla/websocket"
+
+	"github.com/armsnyder/awswebsocketadapter"
+)
+
+// echoHandler returns a handler that writes every message back to the connection it came from.
+func echoHandler(adapter *awswebsocketadapter.Adapter) awswebsocketadapter.LambdaHandler {
+	return func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.RequestContext.EventType == "MESSAGE" {
+			_, err := adapter.PostToConnectionWithContext(ctx, &apigatewaymanagementapi.PostToConnectionInput{
+				ConnectionId: &request.RequestContext.ConnectionID,
+				Data:         []byte(request.Body),
+			})
+			if err != nil {
+				return events.APIGatewayProxyResponse{}, err
+			}
+		}
+
+		return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+	}
+}
+
+// recordingHandler returns a handler that sends every request it receives to requests.
+func recordingHandler(requests chan<- events.APIGatewayWebsocketProxyRequest) awswebsocketadapter.LambdaHandler {
+	return func(_ context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		requests <- request
+		return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+	}
+}
+
+// waitForEvent returns the next request of the given event type, skipping requests of other types.
+func waitForEvent(t *testing.T, requests <-chan events.APIGatewayWebsocketProxyRequest, eventType string) events.APIGatewayWebsocketProxyRequest {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case request := <-requests:
+			if request.RequestContext.EventType == eventType {
+				return request
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s event", eventType)
+		}
+	}
+}
+
+// expectNoEvent fails if a request arrives shortly.
+func expectNoEvent(t *testing.T, requests <-chan events.APIGatewayWebsocketProxyRequest) {
+	t.Helper()
+
+	select {
+	case request := <-requests:
+		t.Fatalf("unexpected %s event", request.RequestContext.EventType)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// recordingLogger is a Logger that sends every message it receives, prefixed with its level, e.g.
+// "WARN slow handler", to the channel.
+type recordingLogger chan string
+
+func (l recordingLogger) Info(msg string, _ ...interface{})  { l <- "INFO " + msg }
+func (l recordingLogger) Warn(msg string, _ ...interface{})  { l <- "WARN " + msg }
+func (l recordingLogger) Error(msg string, _ ...interface{}) { l <- "ERROR " + msg }
+
+// waitForLog waits for the given log message, skipping other messages.
+func waitForLog(t *testing.T, logs <-chan string, expected string) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case message := <-logs:
+			if message == expected {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for log message %q", expected)
+		}
+	}
+}
+
+// recordingMetrics is a Metrics and WriteBufferPoolMetrics that records its observations.
+type recordingMetrics struct {
+	mu               sync.Mutex
+	inboundSizes     []int
+	outboundSizes    []int
+	upgradeDurations []time.Duration
+	bufferHits       int
+	bufferMisses     int
+}
+
+func (m *recordingMetrics) ObserveInboundSize(size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inboundSizes = append(m.inboundSizes, size)
+}
+
+func (m *recordingMetrics) ObserveOutboundSize(size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outboundSizes = append(m.outboundSizes, size)
+}
+
+func (m *recordingMetrics) ObserveUpgradeDuration(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.upgradeDurations = append(m.upgradeDurations, d)
+}
+
+func (m *recordingMetrics) ObserveWriteBufferGet(hit bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if hit {
+		m.bufferHits++
+	} else {
+		m.bufferMisses++
+	}
+}
+
+// fallbackAPI is a management API client that records the connection IDs of the messages posted
+// to it. Its other methods are not implemented.
+type fallbackAPI struct {
+	apigatewaymanagementapiiface.ApiGatewayManagementApiAPI
+
+	posted chan string
+}
+
+func (f *fallbackAPI) PostToConnectionWithContext(_ aws.Context, input *apigatewaymanagementapi.PostToConnectionInput, _ ...request.Option) (*apigatewaymanagementapi.PostToConnectionOutput, error) {
+	f.posted <- *input.ConnectionId
+	return &apigatewaymanagementapi.PostToConnectionOutput{}, nil
+}
+
+// connect opens a websocket connection to server and returns it with its connection ID, once the
+// adapter is ready to accept management API calls for it. The adapter's handler must record its
+// requests to requests.
+func connect(t *testing.T, server *httptest.Server, requests <-chan events.APIGatewayWebsocketProxyRequest) (*websocket.Conn, string) {
+	t.Helper()
+
+	ws := dial(t, server)
+	connID := waitForEvent(t, requests, "CONNECT").RequestContext.ConnectionID
+
+	// The connection is registered after the CONNECT handler returns but before any message is
+	// handled.
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, requests, "MESSAGE")
+
+	return ws, connID
+}
+
+// dial opens a websocket connection to server.
+func dial(tb testing.TB, server *httptest.Server) *websocket.Conn {
+	tb.Helper()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return ws
+}
+
+func BenchmarkRoundTrip(b *testing.B) {
+	var adapter awswebsocketadapter.Adapter
+	adapter.LambdaHandler = echoHandler(&adapter)
+
+	server := httptest.NewServer(&adapter)
+	defer server.Close()
+
+	ws := dial(b, server)
+	defer ws.Close()
+
+	message := []byte(`{"action":"echo"}`)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := ws.WriteMessage(websocket.TextMessage, message); err != nil {
+			b.Fatal(err)
+		}
+
+		if _, _, err := ws.ReadMessage(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkManyConnections(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			var adapter awswebsocketadapter.Adapter
+			adapter.LambdaHandler = echoHandler(&adapter)
+
+			server := httptest.NewServer(&adapter)
+			defer server.Close()
+
+			conns := make([]*websocket.Conn, n)
+			for i := range conns {
+				conns[i] = dial(b, server)
+				defer conns[i].Close()
+			}
+
+			message := []byte(`{"action":"echo"}`)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				ws := conns[i%n]
+
+				if err := ws.WriteMessage(websocket.TextMessage, message); err != nil {
+					b.Fatal(err)
+				}
+
+				if _, _, err := ws.ReadMessage(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteConnection(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, connID := connect(t, server, requests)
+	defer ws.Close()
+
+	input := &apigatewaymanagementapi.DeleteConnectionInput{ConnectionId: &connID}
+	if _, err := adapter.DeleteConnection(input); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected normal closure, got %v", err)
+	}
+
+	waitForEvent(t, requests, "DISCONNECT")
+	expectNoEvent(t, requests)
+
+	var gone *apigatewaymanagementapi.GoneException
+	if _, err := adapter.DeleteConnection(input); !errors.As(err, &gone) {
+		t.Fatalf("expected GoneException, got %v", err)
+	}
+}
+
+func TestPostToConnectionDuringDisconnect(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	errs := make(chan error, 2)
+
+	adapter := &awswebsocketadapter.Adapter{}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.RequestContext.EventType == "DISCONNECT" {
+			_, err := adapter.PostToConnectionWithContext(ctx, &apigatewaymanagementapi.PostToConnectionInput{
+				ConnectionId: &request.RequestContext.ConnectionID,
+				Data:         []byte("goodbye"),
+			})
+			errs <- err
+			errs <- adapter.InjectMessage(request.RequestContext.ConnectionID, "late")
+		}
+
+		return recordingHandler(requests)(ctx, request)
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	ws.Close()
+
+	waitForEvent(t, requests, "DISCONNECT")
+
+	for i := 0; i < 2; i++ {
+		var gone *apigatewaymanagementapi.GoneException
+		if err := <-errs; !errors.As(err, &gone) {
+			t.Fatalf("expected GoneException, got %v", err)
+		}
+	}
+
+	expectNoEvent(t, requests)
+}
+
+func TestGetConnection(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	before := time.Now()
+	ws, connID := connect(t, server, requests)
+	defer ws.Close()
+
+	output, err := adapter.GetConnection(&apigatewaymanagementapi.GetConnectionInput{ConnectionId: &connID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if output.ConnectedAt.Before(before) {
+		t.Errorf("ConnectedAt %v is before the connection was opened at %v", *output.ConnectedAt, before)
+	}
+
+	if output.LastActiveAt.Before(*output.ConnectedAt) {
+		t.Errorf("LastActiveAt %v is before ConnectedAt %v", *output.LastActiveAt, *output.ConnectedAt)
+	}
+
+	if *output.Identity.SourceIp != "127.0.0.1" {
+		t.Errorf("expected source IP 127.0.0.1, got %q", *output.Identity.SourceIp)
+	}
+
+	unknown := "unknown"
+	var gone *apigatewaymanagementapi.GoneException
+	if _, err := adapter.GetConnection(&apigatewaymanagementapi.GetConnectionInput{ConnectionId: &unknown}); !errors.As(err, &gone) {
+		t.Fatalf("expected GoneException, got %v", err)
+	}
+}
+
+func TestConcurrentPostToConnection(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, connID := connect(t, server, requests)
+	defer ws.Close()
+
+	const n = 100
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := adapter.PostToConnection(&apigatewaymanagementapi.PostToConnectionInput{
+				ConnectionId: &connID,
+				Data:         []byte("hello"),
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		if _, message, err := ws.ReadMessage(); err != nil {
+			t.Fatal(err)
+		} else if string(message) != "hello" {
+			t.Fatalf("expected hello, got %q", message)
+		}
+	}
+
+	wg.Wait()
+}
+
+func TestConnectRejected(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		requests <- request
+		if request.RequestContext.EventType == "CONNECT" {
+			return events.APIGatewayProxyResponse{StatusCode: http.StatusForbidden}, nil
+		}
+		return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status 403, got %v", resp)
+	}
+
+	waitForEvent(t, requests, "CONNECT")
+	expectNoEvent(t, requests)
+}
+
+func TestConnectRedirect(t *testing.T) {
+	adapter := &awswebsocketadapter.Adapter{}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusTemporaryRedirect,
+			Headers:    map[string]string{"Location": "wss://example.com/elsewhere"},
+		}, nil
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("expected status 307, got %v", resp)
+	}
+	if location := resp.Header.Get("Location"); location != "wss://example.com/elsewhere" {
+		t.Fatalf("expected the Location header of the handler, got %q", location)
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler awswebsocketadapter.LambdaHandler
+	}{
+		{
+			name: "returns ctx.Err()",
+			handler: func(ctx context.Context, _ events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+				<-ctx.Done()
+				return events.APIGatewayProxyResponse{}, ctx.Err()
+			},
+		},
+		{
+			name: "ignores ctx",
+			handler: func(ctx context.Context, _ events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+				<-ctx.Done()
+				return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &awswebsocketadapter.Adapter{
+				LambdaHandler:  tt.handler,
+				ConnectTimeout: 50 * time.Millisecond,
+			}
+
+			server := httptest.NewServer(adapter)
+			defer server.Close()
+
+			_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err == nil {
+				t.Fatal("expected the handshake to fail")
+			}
+			if resp == nil || resp.StatusCode != http.StatusGatewayTimeout {
+				t.Fatalf("expected status 504, got %v", resp)
+			}
+		})
+	}
+}
+
+func TestDisconnectStatus(t *testing.T) {
+	type status struct {
+		code int
+		text string
+	}
+
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	statuses := make(chan status, 1)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.RequestContext.EventType == "DISCONNECT" {
+			code, text := awswebsocketadapter.DisconnectStatusFromContext(ctx)
+			statuses <- status{code, text}
+		}
+		return record(ctx, request)
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "bye")
+	if err := ws.WriteMessage(websocket.CloseMessage, closeMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForEvent(t, requests, "DISCONNECT")
+
+	if got := <-statuses; got != (status{websocket.CloseGoingAway, "bye"}) {
+		t.Fatalf("expected status 1001 \"bye\", got %d %q", got.code, got.text)
+	}
+}
+
+func TestConnectionIDPrefix(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests), ConnectionIDPrefix: "stageA-"}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, connID := connect(t, server, requests)
+	defer ws.Close()
+
+	if !strings.HasPrefix(connID, "stageA-") {
+		t.Fatalf("expected connection ID with prefix stageA-, got %q", connID)
+	}
+
+	input := &apigatewaymanagementapi.PostToConnectionInput{ConnectionId: &connID, Data: []byte("hi")}
+	if _, err := adapter.PostToConnection(input); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, message, err := ws.ReadMessage(); err != nil || string(message) != "hi" {
+		t.Fatalf("expected message hi, got %q, %v", message, err)
+	}
+}
+
+func TestForeignConnectionIDPrefixes(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	other := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests), ConnectionIDPrefix: "apiB-"}
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler:               recordingHandler(requests),
+		ConnectionIDPrefix:          "apiA-",
+		ForeignConnectionIDPrefixes: []string{"apiB-"},
+	}
+
+	server := httptest.NewServer(other)
+	defer server.Close()
+
+	ws, connID := connect(t, server, requests)
+	defer ws.Close()
+
+	// A connection of the other adapter is forbidden rather than gone.
+	input := &apigatewaymanagementapi.PostToConnectionInput{ConnectionId: &connID, Data: []byte("hi")}
+	_, err := adapter.PostToConnection(input)
+	var forbidden *apigatewaymanagementapi.ForbiddenException
+	if !errors.As(err, &forbidden) {
+		t.Fatalf("expected ForbiddenException, got %v", err)
+	}
+
+	unknown := "apiA-unknown"
+	_, err = adapter.GetConnection(&apigatewaymanagementapi.GetConnectionInput{ConnectionId: &unknown})
+	var gone *apigatewaymanagementapi.GoneException
+	if !errors.As(err, &gone) {
+		t.Fatalf("expected GoneException, got %v", err)
+	}
+}
+
+func TestDuplicateConnectionID(t *testing.T) {
+	t.Run("reject", func(t *testing.T) {
+		requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+		adapter := &awswebsocketadapter.Adapter{
+			LambdaHandler:    recordingHandler(requests),
+			ConnectionIDFunc: func() (string, error) { return "fixed", nil },
+		}
+
+		server := httptest.NewServer(adapter)
+		defer server.Close()
+
+		ws, connID := connect(t, server, requests)
+		defer ws.Close()
+
+		if connID != "fixed" {
+			t.Fatalf("expected connection ID fixed, got %q", connID)
+		}
+
+		_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err == nil {
+			t.Fatal("expected the handshake to fail")
+		}
+		if resp == nil || resp.StatusCode != http.StatusConflict {
+			t.Fatalf("expected status 409, got %v", resp)
+		}
+
+		expectNoEvent(t, requests)
+	})
+
+	t.Run("takeover", func(t *testing.T) {
+		requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+		reasons := make(chan awswebsocketadapter.DisconnectReason, 1)
+		record := recordingHandler(requests)
+		adapter := &awswebsocketadapter.Adapter{
+			ConnectionIDFunc:          func() (string, error) { return "alice", nil },
+			DuplicateConnectionPolicy: awswebsocketadapter.DuplicateTakeover,
+		}
+		adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+			if request.RequestContext.EventType == "DISCONNECT" {
+				reasons <- awswebsocketadapter.DisconnectReasonFromContext(ctx)
+			}
+			return record(ctx, request)
+		}
+
+		server := httptest.NewServer(adapter)
+		defer server.Close()
+
+		ws1, _ := connect(t, server, requests)
+		defer ws1.Close()
+
+		ws2, connID := connect(t, server, requests)
+		defer ws2.Close()
+
+		if connID != "alice" {
+			t.Fatalf("expected connection ID alice, got %q", connID)
+		}
+
+		if _, _, err := ws1.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.Fatalf("expected the first connection to be closed with 1000, got %v", err)
+		}
+		select {
+		case reason := <-reasons:
+			if reason != awswebsocketadapter.DisconnectReplaced {
+				t.Fatalf("expected disconnect reason replaced, got %q", reason)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the DISCONNECT event of the first connection")
+		}
+
+		// Management API calls for the ID reach the new connection.
+		input := &apigatewaymanagementapi.PostToConnectionInput{ConnectionId: &connID, Data: []byte("hi")}
+		if _, err := adapter.PostToConnection(input); err != nil {
+			t.Fatal(err)
+		}
+		if _, message, err := ws2.ReadMessage(); err != nil || string(message) != "hi" {
+			t.Fatalf("expected message hi, got %q, %v", message, err)
+		}
+	})
+
+	t.Run("suffix", func(t *testing.T) {
+		requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+		adapter := &awswebsocketadapter.Adapter{
+			LambdaHandler:             recordingHandler(requests),
+			ConnectionIDFunc:          func() (string, error) { return "fixed", nil },
+			DuplicateConnectionPolicy: awswebsocketadapter.DuplicateSuffix,
+		}
+
+		server := httptest.NewServer(adapter)
+		defer server.Close()
+
+		for _, expected := range []string{"fixed", "fixed-2", "fixed-3"} {
+			ws, connID := connect(t, server, requests)
+			defer ws.Close()
+
+			if connID != expected {
+				t.Fatalf("expected connection ID %s, got %q", expected, connID)
+			}
+		}
+	})
+}
+
+func TestIdentity(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("User-Agent", "test-agent")
+	header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, eventType := range []string{"CONNECT", "MESSAGE", "DISCONNECT"} {
+		switch eventType {
+		case "MESSAGE":
+			if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+		case "DISCONNECT":
+			ws.Close()
+		}
+
+		identity := waitForEvent(t, requests, eventType).RequestContext.Identity
+		if identity.SourceIP != "203.0.113.7" {
+			t.Errorf("%s: expected source IP 203.0.113.7, got %q", eventType, identity.SourceIP)
+		}
+		if identity.UserAgent != "test-agent" {
+			t.Errorf("%s: expected user agent test-agent, got %q", eventType, identity.UserAgent)
+		}
+	}
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	reconnected := make(chan struct{})
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{MaxConnectionsPerIP: 1}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		res, err := record(ctx, request)
+		if request.RequestContext.EventType == "DISCONNECT" {
+			// Hold the DISCONNECT handler until the client has reconnected.
+			<-reconnected
+		}
+		return res, err
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	header := http.Header{}
+	header.Set("X-Forwarded-For", "203.0.113.1")
+	ws, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A different X-Forwarded-For does not get around the limit.
+	header.Set("X-Forwarded-For", "203.0.113.2")
+	_, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %v", resp)
+	}
+
+	// The client can reconnect as soon as its DISCONNECT handler starts.
+	ws.Close()
+	waitForEvent(t, requests, "DISCONNECT")
+
+	ws, _, err = websocket.DefaultDialer.Dial(url, nil)
+	close(reconnected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Close()
+}
+
+func TestShutdown(t *testing.T) {
+	const connections = 3
+
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	closeErrs := make(chan error, connections)
+	for i := 0; i < connections; i++ {
+		ws, _ := connect(t, server, requests)
+		defer ws.Close()
+
+		// Keep reading, so that the client completes the close handshake.
+		go func() {
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					closeErrs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := adapter.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < connections; i++ {
+		if err := <-closeErrs; !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("expected going away closure, got %v", err)
+		}
+		waitForEvent(t, requests, "DISCONNECT")
+	}
+	expectNoEvent(t, requests)
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %v", resp)
+	}
+}
+
+func TestOnShutdownDisconnect(t *testing.T) {
+	const connections = 3
+
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	batches := make(chan []string, 1)
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler:        recordingHandler(requests),
+		OnShutdownDisconnect: func(connIDs []string) { batches <- connIDs },
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	connIDs := make(map[string]bool)
+	for i := 0; i < connections; i++ {
+		ws, connID := connect(t, server, requests)
+		defer ws.Close()
+		connIDs[connID] = true
+
+		go func() {
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := adapter.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connections are reported together instead of with a DISCONNECT event each.
+	batch := <-batches
+	if len(batch) != connections {
+		t.Fatalf("expected %d connection IDs, got %v", connections, batch)
+	}
+	for _, connID := range batch {
+		if !connIDs[connID] {
+			t.Fatalf("unexpected connection ID %q", connID)
+		}
+	}
+	expectNoEvent(t, requests)
+}
+
+func TestShuttingDown(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	shuttingDown := make(chan bool, 10)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.RequestContext.EventType != "CONNECT" {
+			shuttingDown <- awswebsocketadapter.ShuttingDownFromContext(ctx)
+		}
+		return record(ctx, request)
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	if <-shuttingDown || adapter.IsShuttingDown() {
+		t.Fatal("expected the adapter not to be shutting down yet")
+	}
+
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := adapter.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The DISCONNECT handler of the connection closed by Shutdown sees it.
+	if !<-shuttingDown || !adapter.IsShuttingDown() {
+		t.Fatal("expected the adapter to be shutting down")
+	}
+}
+
+func TestDomainName(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("Host", "tenant.example.com:8080")
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	if domain := waitForEvent(t, requests, "CONNECT").RequestContext.DomainName; domain != "tenant.example.com:8080" {
+		t.Fatalf("expected domain name tenant.example.com:8080, got %q", domain)
+	}
+}
+
+func TestStageDomainNameAndAPIID(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler: recordingHandler(requests),
+		Stage:         "dev",
+		DomainName:    "api.example.com",
+		APIID:         "abc123",
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	ws.Close()
+
+	requestContext := waitForEvent(t, requests, "DISCONNECT").RequestContext
+	if requestContext.Stage != "dev" || requestContext.DomainName != "api.example.com" || requestContext.APIID != "abc123" {
+		t.Fatalf("expected stage dev, domain name api.example.com and API ID abc123, got %q, %q and %q",
+			requestContext.Stage, requestContext.DomainName, requestContext.APIID)
+	}
+}
+
+func TestManagementAPIEndpoint(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests), Stage: "dev"}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+
+	// Build the endpoint like a handler in AWS, except over plain HTTP.
+	requestContext := waitForEvent(t, requests, "CONNECT").RequestContext
+	endpoint := "http://" + requestContext.DomainName + "/" + requestContext.Stage
+	connURL := endpoint + "/@connections/" + url.PathEscape(requestContext.ConnectionID)
+
+	// Wait for the connection to be registered.
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, requests, "MESSAGE")
+
+	resp, err := http.Post(connURL, "application/octet-stream", strings.NewReader("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	if _, message, err := ws.ReadMessage(); err != nil || string(message) != "hi" {
+		t.Fatalf("expected message hi, got %q, %v", message, err)
+	}
+
+	resp, err = http.Get(connURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var connection struct {
+		ConnectedAt string `json:"connectedAt"`
+		Identity    struct {
+			SourceIP string `json:"sourceIp"`
+		} `json:"identity"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&connection)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connection.ConnectedAt == "" || connection.Identity.SourceIP != "127.0.0.1" {
+		t.Fatalf("expected the connection's details, got %+v", connection)
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, connURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", resp.StatusCode)
+	}
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected close code 1000, got %v", err)
+	}
+	waitForEvent(t, requests, "DISCONNECT")
+
+	// Calls for a closed connection fail like in API Gateway.
+	resp, err = http.Post(connURL, "application/octet-stream", strings.NewReader("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone || resp.Header.Get("X-Amzn-Errortype") != "GoneException" {
+		t.Fatalf("expected status 410 with a GoneException, got %d %q", resp.StatusCode, resp.Header.Get("X-Amzn-Errortype"))
+	}
+}
+
+func TestQueryStringParameters(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/?token=abc&tenant=41&tenant=42"
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := waitForEvent(t, requests, "CONNECT")
+	if request.QueryStringParameters["token"] != "abc" || request.QueryStringParameters["tenant"] != "42" {
+		t.Errorf("unexpected query string parameters %v", request.QueryStringParameters)
+	}
+	if tenants := request.MultiValueQueryStringParameters["tenant"]; len(tenants) != 2 || tenants[0] != "41" || tenants[1] != "42" {
+		t.Errorf("unexpected multi-value query string parameters %v", request.MultiValueQueryStringParameters)
+	}
+
+	// Like API Gateway, other events do not carry the query string.
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if request := waitForEvent(t, requests, "MESSAGE"); request.QueryStringParameters != nil || request.MultiValueQueryStringParameters != nil {
+		t.Errorf("expected no query string parameters on MESSAGE, got %v", request.MultiValueQueryStringParameters)
+	}
+
+	ws.Close()
+	if request := waitForEvent(t, requests, "DISCONNECT"); request.QueryStringParameters != nil || request.MultiValueQueryStringParameters != nil {
+		t.Errorf("expected no query string parameters on DISCONNECT, got %v", request.MultiValueQueryStringParameters)
+	}
+}
+
+func TestRequiredHeaders(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests), RequiredHeaders: []string{"X-Api-Key"}}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %v", resp)
+	}
+	expectNoEvent(t, requests)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{"X-Api-Key": {"secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	waitForEvent(t, requests, "CONNECT")
+}
+
+func TestPingInterval(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests), PingInterval: 50 * time.Millisecond}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	// Reading answers pings with pongs, which keeps the connection alive.
+	alive, aliveID := connect(t, server, requests)
+	defer alive.Close()
+	go func() {
+		for {
+			if _, _, err := alive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// A client that stops reading never answers.
+	dead, deadID := connect(t, server, requests)
+	defer dead.Close()
+
+	if connID := waitForEvent(t, requests, "DISCONNECT").RequestContext.ConnectionID; connID != deadID {
+		t.Fatalf("expected connection %s to disconnect, got %s", deadID, connID)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	expectNoEvent(t, requests)
+
+	if _, err := adapter.GetConnection(&apigatewaymanagementapi.GetConnectionInput{ConnectionId: &aliveID}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	reasons := make(chan awswebsocketadapter.DisconnectReason, 1)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{IdleTimeout: 100 * time.Millisecond}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.RequestContext.EventType == "DISCONNECT" {
+			reasons <- awswebsocketadapter.DisconnectReasonFromContext(ctx)
+		}
+		return record(ctx, request)
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	_, _, err := ws.ReadMessage()
+	if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != websocket.CloseNormalClosure || closeErr.Text != "idle timeout" {
+		t.Fatalf("expected normal closure with reason idle timeout, got %v", err)
+	}
+
+	waitForEvent(t, requests, "DISCONNECT")
+
+	if reason := <-reasons; reason != awswebsocketadapter.DisconnectIdleTimeout {
+		t.Fatalf("expected reason %s, got %s", awswebsocketadapter.DisconnectIdleTimeout, reason)
+	}
+}
+
+func TestPostToConnectionRequest(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, connID := connect(t, server, requests)
+	defer ws.Close()
+
+	req, _ := adapter.PostToConnectionRequest(&apigatewaymanagementapi.PostToConnectionInput{ConnectionId: &connID, Data: []byte("hi")})
+	if err := req.Send(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, message, err := ws.ReadMessage(); err != nil || string(message) != "hi" {
+		t.Fatalf("expected message hi, got %q, %v", message, err)
+	}
+
+	unknown := "unknown"
+	req, _ = adapter.PostToConnectionRequest(&apigatewaymanagementapi.PostToConnectionInput{ConnectionId: &unknown, Data: []byte("hi")})
+	var gone *apigatewaymanagementapi.GoneException
+	if err := req.Send(); !errors.As(err, &gone) {
+		t.Fatalf("expected GoneException, got %v", err)
+	}
+}
+
+func TestGetAndDeleteConnectionRequest(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, connID := connect(t, server, requests)
+	defer ws.Close()
+
+	getReq, output := adapter.GetConnectionRequest(&apigatewaymanagementapi.GetConnectionInput{ConnectionId: &connID})
+	if err := getReq.Send(); err != nil {
+		t.Fatal(err)
+	}
+	if output.ConnectedAt == nil || output.Identity == nil || *output.Identity.SourceIp != "127.0.0.1" {
+		t.Fatalf("expected the connection's details, got %v", output)
+	}
+
+	deleteReq, _ := adapter.DeleteConnectionRequest(&apigatewaymanagementapi.DeleteConnectionInput{ConnectionId: &connID})
+	if err := deleteReq.Send(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected normal closure, got %v", err)
+	}
+	waitForEvent(t, requests, "DISCONNECT")
+
+	getReq, _ = adapter.GetConnectionRequest(&apigatewaymanagementapi.GetConnectionInput{ConnectionId: &connID})
+	var gone *apigatewaymanagementapi.GoneException
+	if err := getReq.Send(); !errors.As(err, &gone) {
+		t.Fatalf("expected GoneException, got %v", err)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	var clients []*websocket.Conn
+	for i := 0; i < 3; i++ {
+		ws, _ := connect(t, server, requests)
+		defer ws.Close()
+		clients = append(clients, ws)
+	}
+
+	sent, err := adapter.Broadcast([]byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != len(clients) {
+		t.Fatalf("expected %d sends, got %d", len(clients), sent)
+	}
+
+	for _, ws := range clients {
+		if _, message, err := ws.ReadMessage(); err != nil || string(message) != "hi" {
+			t.Fatalf("expected message hi, got %q, %v", message, err)
+		}
+	}
+}
+
+func TestBroadcastOutboundFilter(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	var blocked string
+	var mu sync.Mutex
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler: recordingHandler(requests),
+		OutboundFilter: func(connID string, _ []byte) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return connID != blocked
+		},
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws1, connID1 := connect(t, server, requests)
+	defer ws1.Close()
+	ws2, _ := connect(t, server, requests)
+	defer ws2.Close()
+
+	mu.Lock()
+	blocked = connID1
+	mu.Unlock()
+
+	sent, err := adapter.Broadcast([]byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 {
+		t.Fatalf("expected 1 send, got %d", sent)
+	}
+
+	if _, message, err := ws2.ReadMessage(); err != nil || string(message) != "hi" {
+		t.Fatalf("expected message hi, got %q, %v", message, err)
+	}
+}
+
+func TestBroadcastOutboundLatency(t *testing.T) {
+	const (
+		connections = 5
+		latency     = 200 * time.Millisecond
+	)
+
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests), OutboundLatency: latency}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	for i := 0; i < connections; i++ {
+		ws, _ := connect(t, server, requests)
+		defer ws.Close()
+	}
+
+	start := time.Now()
+	if _, err := adapter.Broadcast([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connections wait for their latency at the same time.
+	if elapsed := time.Since(start); elapsed >= connections*latency/2 {
+		t.Fatalf("expected the broadcast to take about %s, took %s", latency, elapsed)
+	}
+}
+
+func TestConnectionIDs(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, connID := connect(t, server, requests)
+
+	if ids := adapter.ConnectionIDs(); len(ids) != 1 || ids[0] != connID {
+		t.Fatalf("expected connection IDs [%s], got %v", connID, ids)
+	}
+
+	ws.Close()
+	waitForEvent(t, requests, "DISCONNECT")
+
+	if ids := adapter.ConnectionIDs(); len(ids) != 0 {
+		t.Fatalf("expected no connection IDs, got %v", ids)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.Body == "panic" {
+			var m map[string]int
+			m["boom"]++
+		}
+		return record(ctx, request)
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("panic")); err != nil {
+		t.Fatal(err)
+	}
+	if _, message, err := ws.ReadMessage(); err != nil || string(message) != `{"message": "Internal server error"}` {
+		t.Fatalf("expected an error message, got %q, %v", message, err)
+	}
+
+	// The connection stays open.
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, requests, "MESSAGE")
+}
+
+func TestConnectHandlerPanic(t *testing.T) {
+	adapter := &awswebsocketadapter.Adapter{}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		panic("boom")
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %v", resp)
+	}
+}
+
+func TestObserverPanic(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	observed := make(chan struct{}, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+	adapter.AddObserver(func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		observed <- struct{}{}
+		panic("boom")
+	})
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	// The panicking observer neither crashes the test binary nor disturbs the connection.
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-observed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the observer")
+		}
+	}
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, requests, "MESSAGE")
+}
+
+func TestErrorResponseFunc(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{
+		MessageIDField: "id",
+		ErrorResponseFunc: func(id json.RawMessage, err error) []byte {
+			if id == nil {
+				id = json.RawMessage("null")
+			}
+			return []byte(`{"error": {"code": "E_HANDLER", "reason": "` + err.Error() + `"}, "id": ` + string(id) + `}`)
+		},
+	}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if strings.Contains(request.Body, "fail") {
+			return events.APIGatewayProxyResponse{}, errors.New("nope")
+		}
+		return record(ctx, request)
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	tests := []struct {
+		message  string
+		expected string
+	}{
+		{message: "fail", expected: `{"error": {"code": "E_HANDLER", "reason": "nope"}, "id": null}`},
+		{message: `{"id": 7, "action": "fail"}`, expected: `{"error": {"code": "E_HANDLER", "reason": "nope"}, "id": 7}`},
+	}
+
+	for _, tt := range tests {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(tt.message)); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, message, err := ws.ReadMessage(); err != nil || string(message) != tt.expected {
+			t.Fatalf("expected %s, got %q, %v", tt.expected, message, err)
+		}
+	}
+}
+
+func TestConnectionHooks(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	hooks := make(chan string, 10)
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler: recordingHandler(requests),
+		OnConnect:     func(connID string) { hooks <- "connect" },
+		OnMessage: func(connID string, size int, duration time.Duration) {
+			hooks <- "message " + strconv.Itoa(size)
+		},
+		OnDisconnect: func(connID string, code int, reason string) {
+			hooks <- "disconnect " + strconv.Itoa(code) + " " + reason
+		},
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "done")
+	if err := ws.WriteMessage(websocket.CloseMessage, closeMessage); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	waitForEvent(t, requests, "DISCONNECT")
+
+	for _, expected := range []string{"connect", "message 5", "disconnect 1000 done"} {
+		if hook := <-hooks; hook != expected {
+			t.Fatalf("expected hook %q, got %q", expected, hook)
+		}
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	type key struct{}
+
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	errs := make(chan error, 10)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if ctx.Value(key{}) != "value" {
+			errs <- errors.New(request.RequestContext.EventType + ": missing request context value")
+		}
+		if err := ctx.Err(); err != nil {
+			errs <- errors.New(request.RequestContext.EventType + ": " + err.Error())
+		}
+		return record(ctx, request)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adapter.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), key{}, "value")))
+	}))
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	ws.Close()
+	waitForEvent(t, requests, "DISCONNECT")
+
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestRelayErrorBodies(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{RelayErrorBodies: true}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.Body == "invalid" {
+			return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: `{"error": "invalid"}`}, nil
+		}
+		return record(ctx, request)
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("invalid")); err != nil {
+		t.Fatal(err)
+	}
+	if _, message, err := ws.ReadMessage(); err != nil || string(message) != `{"error": "invalid"}` {
+		t.Fatalf("expected the response body, got %q, %v", message, err)
+	}
+
+	// The connection stays open.
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, requests, "MESSAGE")
+}
+
+func TestHandlers(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{
+		RouteSelectionExpression: "$request.body.action",
+		Handlers: map[string]awswebsocketadapter.LambdaHandler{
+			"$connect":    recordingHandler(requests),
+			"sendMessage": recordingHandler(requests),
+		},
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+
+	waitForEvent(t, requests, "CONNECT")
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"action": "sendMessage"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if routeKey := waitForEvent(t, requests, "MESSAGE").RequestContext.RouteKey; routeKey != "sendMessage" {
+		t.Fatalf("expected route key sendMessage, got %s", routeKey)
+	}
+
+	// Without a $default handler, unmatched routes are answered with an error.
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"action": "other"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, message, err := ws.ReadMessage(); err != nil || string(message) != `{"message": "Internal server error"}` {
+		t.Fatalf("expected an error message, got %q, %v", message, err)
+	}
+	expectNoEvent(t, requests)
+}
+
+func TestMaxConcurrentInvocations(t *testing.T) {
+	var mu sync.Mutex
+	var active, maxActive int
+
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{MaxConcurrentInvocations: 1}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+
+		return record(ctx, request)
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	var clients []*websocket.Conn
+	for i := 0; i < 3; i++ {
+		ws, _ := connect(t, server, requests)
+		defer ws.Close()
+		clients = append(clients, ws)
+	}
+
+	for _, ws := range clients {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range clients {
+		waitForEvent(t, requests, "MESSAGE")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxActive != 1 {
+		t.Fatalf("expected at most 1 concurrent invocation, got %d", maxActive)
+	}
+}
+
+func TestMessageOrdering(t *testing.T) {
+	const messages = 20
+
+	var mu sync.Mutex
+	received := make(map[string][]string)
+
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 2*messages)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{MaxConcurrentInvocations: 2}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.RequestContext.EventType == "MESSAGE" && request.Body != "hello" {
+			// Vary the handler duration, so that out-of-order handling would show.
+			n, _ := strconv.Atoi(request.Body)
+			time.Sleep(time.Duration(messages-n) * time.Millisecond)
+
+			mu.Lock()
+			received[request.RequestContext.ConnectionID] = append(received[request.RequestContext.ConnectionID], request.Body)
+			mu.Unlock()
+		}
+		return record(ctx, request)
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws1, connID1 := connect(t, server, requests)
+	defer ws1.Close()
+	ws2, connID2 := connect(t, server, requests)
+	defer ws2.Close()
+
+	for i := 0; i < messages; i++ {
+		for _, ws := range []*websocket.Conn{ws1, ws2} {
+			if err := ws.WriteMessage(websocket.TextMessage, []byte(strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 2*messages; i++ {
+		waitForEvent(t, requests, "MESSAGE")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, connID := range []string{connID1, connID2} {
+		for i, body := range received[connID] {
+			if body != strconv.Itoa(i) {
+				t.Fatalf("connection %s: expected message %d at position %d, got %v", connID, i, i, received[connID])
+			}
+		}
+		if len(received[connID]) != messages {
+			t.Fatalf("connection %s: expected %d messages, got %d", connID, messages, len(received[connID]))
+		}
+	}
+}
+
+func TestUpgraderCheckOrigin(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+	adapter.Upgrader.CheckOrigin = func(r *http.Request) bool {
+		return r.Header.Get("Origin") == "https://example.com"
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example.com"}})
+	if err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status 403, got %v", resp)
+	}
+	expectNoEvent(t, requests)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	waitForEvent(t, requests, "CONNECT")
+}
+
+func TestInvalidHandshake(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		header     http.Header
+		wantStatus int
+	}{
+		{
+			name:       "unsupported version",
+			method:     http.MethodGet,
+			header:     http.Header{"Sec-Websocket-Version": {"8"}, "Sec-Websocket-Key": {"dGhlIHNhbXBsZSBub25jZQ=="}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing key",
+			method:     http.MethodGet,
+			header:     http.Header{"Sec-Websocket-Version": {"13"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "wrong method",
+			method:     http.MethodPost,
+			header:     http.Header{"Sec-Websocket-Version": {"13"}, "Sec-Websocket-Key": {"dGhlIHNhbXBsZSBub25jZQ=="}},
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+			adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+
+			server := httptest.NewServer(adapter)
+			defer server.Close()
+
+			req, err := http.NewRequest(tt.method, server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header = tt.header
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+
+			// The handshake is refused before the CONNECT handler, which would otherwise never see a
+			// DISCONNECT.
+			expectNoEvent(t, requests)
+		})
+	}
+}
+
+func TestSubprotocol(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	subprotocols := make(chan string, 1)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{}
+	adapter.Upgrader.Subprotocols = []string{"graphql-transport-ws"}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.RequestContext.EventType == "CONNECT" {
+			subprotocols <- awswebsocketadapter.SubprotocolFromContext(ctx)
+		}
+		return record(ctx, request)
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"graphql-ws", "graphql-transport-ws"}}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	if subprotocol := ws.Subprotocol(); subprotocol != "graphql-transport-ws" {
+		t.Fatalf("expected the handshake to select graphql-transport-ws, got %q", subprotocol)
+	}
+
+	if subprotocol := <-subprotocols; subprotocol != "graphql-transport-ws" {
+		t.Fatalf("expected the handler to see graphql-transport-ws, got %q", subprotocol)
+	}
+}
+
+func TestAllowBinaryMessages(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{AllowBinaryMessages: true}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.IsBase64Encoded {
+			data, err := base64.StdEncoding.DecodeString(request.Body)
+			if err != nil {
+				return events.APIGatewayProxyResponse{}, err
+			}
+			_, err = adapter.PostBinaryToConnection(&apigatewaymanagementapi.PostToConnectionInput{
+				ConnectionId: &request.RequestContext.ConnectionID,
+				Data:         data,
+			})
+			if err != nil {
+				return events.APIGatewayProxyResponse{}, err
+			}
+		}
+		return record(ctx, request)
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.BinaryMessage, []byte{0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if request := waitForEvent(t, requests, "MESSAGE"); !request.IsBase64Encoded || request.Body != "AAEC" {
+		t.Fatalf("expected base64-encoded body AAEC, got %q (IsBase64Encoded %v)", request.Body, request.IsBase64Encoded)
+	}
+
+	mt, message, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt != websocket.BinaryMessage || !bytes.Equal(message, []byte{0, 1, 2}) {
+		t.Fatalf("expected binary message [0 1 2], got type %d %v", mt, message)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests), WriteTimeout: 100 * time.Millisecond}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	// The client never reads, so writes block once the socket buffers are full.
+	ws, connID := connect(t, server, requests)
+	defer ws.Close()
+
+	input := &apigatewaymanagementapi.PostToConnectionInput{ConnectionId: &connID, Data: make([]byte, 1<<20)}
+	var err error
+	for i := 0; i < 1000 && err == nil; i++ {
+		_, err = adapter.PostToConnection(input)
+	}
+	if err == nil {
+		t.Fatal("expected a write to time out")
+	}
+
+	waitForEvent(t, requests, "DISCONNECT")
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests), MaxMessageSize: 16}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 32))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("expected close code 1009, got %v", err)
+	}
+
+	waitForEvent(t, requests, "DISCONNECT")
+}
+
+func TestMessageTooBigCloseCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     int
+		codeFunc func(connID string, r *http.Request) int
+		wantCode int
+	}{
+		{name: "custom", code: 4009, wantCode: 4009},
+		{
+			name:     "per connection",
+			code:     4009,
+			codeFunc: func(string, *http.Request) int { return 4010 },
+			wantCode: 4010,
+		},
+		{
+			name:     "per connection default",
+			code:     4009,
+			codeFunc: func(string, *http.Request) int { return 0 },
+			wantCode: 4009,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+			adapter := &awswebsocketadapter.Adapter{
+				LambdaHandler:              recordingHandler(requests),
+				MaxMessageSize:             16,
+				MessageTooBigCloseCode:     tt.code,
+				MessageTooBigCloseCodeFunc: tt.codeFunc,
+			}
+
+			server := httptest.NewServer(adapter)
+			defer server.Close()
+
+			ws, _ := connect(t, server, requests)
+			defer ws.Close()
+
+			if err := ws.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 32))); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, tt.wantCode) {
+				t.Fatalf("expected close code %d, got %v", tt.wantCode, err)
+			}
+
+			waitForEvent(t, requests, "DISCONNECT")
+			expectNoEvent(t, requests)
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.Body == "fail" {
+			return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+		}
+		return record(ctx, request)
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws1, _ := connect(t, server, requests)
+	defer ws1.Close()
+	ws2, _ := connect(t, server, requests)
+
+	if err := ws1.WriteMessage(websocket.TextMessage, []byte("fail")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ws1.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	ws2.Close()
+	waitForEvent(t, requests, "DISCONNECT")
+
+	expected := awswebsocketadapter.Stats{
+		ActiveConnections:  1,
+		TotalConnections:   2,
+		TotalMessages:      3,
+		TotalHandlerErrors: 1,
+	}
+	if stats := adapter.Stats(); stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestNoHandler(t *testing.T) {
+	server := httptest.NewServer(&awswebsocketadapter.Adapter{})
+	defer server.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %v", resp)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	before := time.Now()
+	ws, connID := connect(t, server, requests)
+	defer ws.Close()
+
+	var requestContexts []events.APIGatewayWebsocketProxyRequestContext
+	for i := 0; i < 2; i++ {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		requestContexts = append(requestContexts, waitForEvent(t, requests, "MESSAGE").RequestContext)
+	}
+
+	for _, requestContext := range requestContexts {
+		if requestContext.ConnectionID != connID {
+			t.Errorf("expected connection ID %s, got %s", connID, requestContext.ConnectionID)
+		}
+		if requestContext.RequestID == "" {
+			t.Error("expected a request ID")
+		}
+		if requestContext.RequestTimeEpoch < before.UnixNano()/int64(time.Millisecond) {
+			t.Errorf("RequestTimeEpoch %d is before the connection was opened", requestContext.RequestTimeEpoch)
+		}
+		if requestContext.RequestTime == "" {
+			t.Error("expected a request time")
+		}
+	}
+
+	if requestContexts[0].RequestID == requestContexts[1].RequestID {
+		t.Errorf("expected different request IDs, got %s twice", requestContexts[0].RequestID)
+	}
+}
+
+func TestMessageContextCanceledOnClose(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	streaming := make(chan struct{})
+	errs := make(chan error, 1)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.Body == "stream" {
+			close(streaming)
+			select {
+			case <-ctx.Done():
+				errs <- ctx.Err()
+			case <-time.After(5 * time.Second):
+				errs <- errors.New("context was not canceled")
+			}
+		}
+		return record(ctx, request)
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, connID := connect(t, server, requests)
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("stream")); err != nil {
+		t.Fatal(err)
+	}
+	<-streaming
+
+	if _, err := adapter.DeleteConnection(&apigatewaymanagementapi.DeleteConnectionInput{ConnectionId: &connID}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests), MaxConnections: 1}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %v", resp)
+	}
+	expectNoEvent(t, requests)
+
+	// Closing the first connection makes room for another.
+	ws.Close()
+	waitForEvent(t, requests, "DISCONNECT")
+
+	ws, _ = connect(t, server, requests)
+	ws.Close()
+}
+
+func TestSheddingPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy awswebsocketadapter.SheddingPolicy
+		// touch is the index of a connection that sends another message before the limit is hit.
+		touch    int
+		wantShed int
+	}{
+		{name: "close oldest", policy: awswebsocketadapter.ShedCloseOldest, touch: 0, wantShed: 0},
+		{name: "close least active", policy: awswebsocketadapter.ShedCloseLeastActive, touch: 0, wantShed: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+			adapter := &awswebsocketadapter.Adapter{
+				LambdaHandler:  recordingHandler(requests),
+				MaxConnections: 2,
+				SheddingPolicy: tt.policy,
+			}
+
+			server := httptest.NewServer(adapter)
+			defer server.Close()
+
+			var conns []*websocket.Conn
+			for i := 0; i < 2; i++ {
+				ws, _ := connect(t, server, requests)
+				defer ws.Close()
+				conns = append(conns, ws)
+			}
+
+			if err := conns[tt.touch].WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			waitForEvent(t, requests, "MESSAGE")
+
+			// The new connection is accepted, and another one is closed to make room for it.
+			ws, _ := connect(t, server, requests)
+			defer ws.Close()
+
+			if _, _, err := conns[tt.wantShed].ReadMessage(); !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+				t.Fatalf("expected connection %d to be closed with 1013, got %v", tt.wantShed, err)
+			}
+
+			if stats := adapter.Stats(); stats.ActiveConnections != 2 {
+				t.Fatalf("expected 2 active connections, got %d", stats.ActiveConnections)
+			}
+		})
+	}
+}
+
+func TestEventTypeAndMessageDirection(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws := dial(t, server)
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, eventType := range []string{
+		awswebsocketadapter.EventTypeConnect,
+		awswebsocketadapter.EventTypeMessage,
+		awswebsocketadapter.EventTypeDisconnect,
+	} {
+		if eventType == awswebsocketadapter.EventTypeDisconnect {
+			ws.Close()
+		}
+
+		request := <-requests
+		if request.RequestContext.EventType != eventType {
+			t.Fatalf("expected event type %s, got %s", eventType, request.RequestContext.EventType)
+		}
+		if request.RequestContext.MessageDirection != "IN" {
+			t.Errorf("%s: expected message direction IN, got %q", eventType, request.RequestContext.MessageDirection)
+		}
+	}
+}
+
+func TestNewTLSServer(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+
+	// Borrow the certificate of an httptest server, and its client's trust in it.
+	certs := httptest.NewTLSServer(http.NotFoundHandler())
+	certs.Close()
+
+	server := adapter.NewTLSServer("", &tls.Config{Certificates: certs.TLS.Certificates})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ServeTLS(listener, "", "")
+	}()
+
+	dialer := websocket.Dialer{TLSClientConfig: certs.Client().Transport.(*http.Transport).TLSClientConfig}
+	ws, _, err := dialer.Dial("wss://"+listener.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, requests, "MESSAGE")
+
+	closeErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				closeErr <- err
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+
+	// Shutting the server down leaves the adapter and its websocket connections alone.
+	select {
+	case err := <-closeErr:
+		t.Fatalf("expected the connection to stay open, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := adapter.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-closeErr; !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected going away closure, got %v", err)
+	}
+	waitForEvent(t, requests, "DISCONNECT")
+}
+
+func TestTLS(t *testing.T) {
+	adapter := &awswebsocketadapter.Adapter{}
+	adapter.LambdaHandler = echoHandler(adapter)
+
+	server := httptest.NewTLSServer(adapter)
+	defer server.Close()
+
+	dialer := websocket.Dialer{TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig}
+	ws, _, err := dialer.Dial("wss"+strings.TrimPrefix(server.URL, "https"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, reply, err := ws.ReadMessage(); err != nil || string(reply) != "hello" {
+		t.Fatalf("expected the message to be echoed, got %q, %v", reply, err)
+	}
+}
+
+func TestRequireReady(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	connected := make(chan string, 1)
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler: recordingHandler(requests),
+		RequireReady:  true,
+		OnConnect:     func(connID string) { connected <- connID },
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+	connID := <-connected
+
+	if err := adapter.InjectMessage(connID, "one"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForEvent(t, requests, "CONNECT")
+	expectNoEvent(t, requests)
+
+	adapter.MarkReady()
+
+	for _, expected := range []string{"one", "two"} {
+		if body := waitForEvent(t, requests, "MESSAGE").Body; body != expected {
+			t.Fatalf("expected %q, got %q", expected, body)
+		}
+	}
+}
+
+func TestReadyBufferSize(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler:   recordingHandler(requests),
+		RequireReady:    true,
+		ReadyBufferSize: 1,
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+	connID := waitForEvent(t, requests, "CONNECT").RequestContext.ConnectionID
+
+	for _, body := range []string{"one", "two"} {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second message does not fit in the buffer.
+	if _, message, err := ws.ReadMessage(); err != nil || string(message) != `{"message": "Internal server error"}` {
+		t.Fatalf("expected an error message, got %q, %v", message, err)
+	}
+
+	// An injected message is handled after the queued one.
+	adapter.MarkReady()
+	if err := adapter.InjectMessage(connID, "three"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"one", "three"} {
+		if body := waitForEvent(t, requests, "MESSAGE").Body; body != expected {
+			t.Fatalf("expected %q, got %q", expected, body)
+		}
+	}
+	expectNoEvent(t, requests)
+}
+
+func TestFirstMessageAuth(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler: recordingHandler(requests),
+		FirstMessageAuth: func(connID string, msg []byte) (map[string]interface{}, error) {
+			if string(msg) != "token" {
+				return nil, errors.New("invalid token")
+			}
+			return map[string]interface{}{"principalId": "alice"}, nil
+		},
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	t.Run("authorized", func(t *testing.T) {
+		ws := dial(t, server)
+		defer ws.Close()
+		waitForEvent(t, requests, "CONNECT")
+
+		// The first message goes to FirstMessageAuth rather than the handler.
+		for _, message := range []string{"token", "hello"} {
+			if err := ws.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		request := waitForEvent(t, requests, "MESSAGE")
+		if request.Body != "hello" {
+			t.Fatalf("expected message hello, got %q", request.Body)
+		}
+		authorizer, _ := request.RequestContext.Authorizer.(map[string]interface{})
+		if principal := authorizer["principalId"]; principal != "alice" {
+			t.Fatalf("expected principal alice, got %v", principal)
+		}
+
+		ws.Close()
+		request = waitForEvent(t, requests, "DISCONNECT")
+		if request.RequestContext.Authorizer == nil {
+			t.Fatal("expected the DISCONNECT event to carry the authorizer")
+		}
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		ws := dial(t, server)
+		defer ws.Close()
+		waitForEvent(t, requests, "CONNECT")
+
+		if err := ws.WriteMessage(websocket.TextMessage, []byte("forged")); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Fatalf("expected close code 1008, got %v", err)
+		}
+
+		waitForEvent(t, requests, "DISCONNECT")
+		expectNoEvent(t, requests)
+	})
+}
+
+func TestFrameDelimiter(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests), FrameDelimiter: '\n'}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("{\"n\":1}\n\n{\"n\":2}\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{`{"n":1}`, `{"n":2}`} {
+		if body := waitForEvent(t, requests, "MESSAGE").Body; body != expected {
+			t.Fatalf("expected %s, got %s", expected, body)
+		}
+	}
+	expectNoEvent(t, requests)
+}
+
+func TestCircuit(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler:          recordingHandler(requests),
+		CircuitRejectsConnect:  true,
+		CircuitSkipsDisconnect: true,
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	adapter.OpenCircuit()
+
+	// Messages are answered without invoking the handler.
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, message, err := ws.ReadMessage(); err != nil || string(message) != `{"message": "Service unavailable"}` {
+		t.Fatalf("expected the circuit open message, got %q, %v", message, err)
+	}
+
+	// New connections are refused.
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %v", resp)
+	}
+
+	adapter.CloseCircuit()
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, requests, "MESSAGE")
+
+	// The DISCONNECT handler is skipped while the circuit is open.
+	adapter.OpenCircuit()
+	ws.Close()
+	expectNoEvent(t, requests)
+}
+
+func TestErrFatal(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.Body == "fatal" {
+			return events.APIGatewayProxyResponse{}, fmt.Errorf("corrupt session: %w", awswebsocketadapter.ErrFatal)
+		}
+		return record(ctx, request)
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("fatal")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection is closed instead of answered with an error message.
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseInternalServerErr) {
+		t.Fatalf("expected close code 1011, got %v", err)
+	}
+
+	waitForEvent(t, requests, "DISCONNECT")
+}
+
+func TestAsyncDisconnect(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{AsyncDisconnect: true, AsyncDisconnectWorkers: 1}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.RequestContext.EventType == "DISCONNECT" {
+			started <- struct{}{}
+			<-release
+		}
+		return record(ctx, request)
+	}
+
+	served := make(chan struct{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adapter.ServeHTTP(w, r)
+		served <- struct{}{}
+	}))
+	defer server.Close()
+
+	ws1, _ := connect(t, server, requests)
+	ws2, _ := connect(t, server, requests)
+	ws1.Close()
+	ws2.Close()
+
+	// The connections are released without waiting for their DISCONNECT handlers.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-served:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for ServeHTTP to return")
+		}
+	}
+
+	// Only AsyncDisconnectWorkers handlers run at a time.
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a DISCONNECT handler")
+	}
+	select {
+	case <-started:
+		t.Fatal("expected only one DISCONNECT handler to run at a time")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Shutdown waits for the DISCONNECT handlers.
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- adapter.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned %v before the DISCONNECT handlers", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Shutdown")
+	}
+
+	waitForEvent(t, requests, "DISCONNECT")
+	waitForEvent(t, requests, "DISCONNECT")
+}
+
+func TestDecompressMessages(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests), DecompressMessages: true}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+	waitForEvent(t, requests, "CONNECT")
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write([]byte(`{"action":"echo"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	message := base64.StdEncoding.EncodeToString(compressed.Bytes())
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	if body := waitForEvent(t, requests, "MESSAGE").Body; body != `{"action":"echo"}` {
+		t.Fatalf("expected the decompressed message, got %q", body)
+	}
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("not gzip")); err != nil {
+		t.Fatal(err)
+	}
+	if _, reply, err := ws.ReadMessage(); err != nil || string(reply) != `{"message": "Invalid compressed message"}` {
+		t.Fatalf("expected an error message, got %q, %v", reply, err)
+	}
+	expectNoEvent(t, requests)
+}
+
+func TestInvocationTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		timeout      time.Duration
+		wantDeadline bool
+	}{
+		{name: "custom", timeout: 50 * time.Millisecond, wantDeadline: true},
+		{name: "negative", timeout: -1, wantDeadline: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+			deadlines := make(chan time.Duration, 1)
+			record := recordingHandler(requests)
+			adapter := &awswebsocketadapter.Adapter{InvocationTimeout: tt.timeout}
+			adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+				if request.Body == "deadline" {
+					deadline, ok := ctx.Deadline()
+					if !ok {
+						deadlines <- 0
+					} else {
+						deadlines <- time.Until(deadline)
+					}
+				}
+				return record(ctx, request)
+			}
+
+			server := httptest.NewServer(adapter)
+			defer server.Close()
+
+			ws, _ := connect(t, server, requests)
+			defer ws.Close()
+
+			if err := ws.WriteMessage(websocket.TextMessage, []byte("deadline")); err != nil {
+				t.Fatal(err)
+			}
+
+			remaining := <-deadlines
+			if !tt.wantDeadline && remaining != 0 {
+				t.Fatalf("expected no deadline, got one in %s", remaining)
+			}
+			if tt.wantDeadline && (remaining <= 0 || remaining > tt.timeout) {
+				t.Fatalf("expected a deadline within %s, got %s", tt.timeout, remaining)
+			}
+		})
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler:     recordingHandler(requests),
+		HeartbeatInterval: 20 * time.Millisecond,
+		HeartbeatMessage:  []byte(`{"type":"heartbeat"}`),
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 2; i++ {
+		if _, message, err := ws.ReadMessage(); err != nil || string(message) != `{"type":"heartbeat"}` {
+			t.Fatalf("expected a heartbeat, got %q, %v", message, err)
+		}
+	}
+}
+
+func TestHeartbeatPing(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler:     recordingHandler(requests),
+		HeartbeatInterval: 20 * time.Millisecond,
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	pings := make(chan struct{}, 10)
+	ws.SetPingHandler(func(string) error {
+		pings <- struct{}{}
+		return nil
+	})
+
+	// Pings are handled while reading, and no message is expected.
+	go func() {
+		for {
+			_, message, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			t.Errorf("expected no message, got %q", message)
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-pings:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a ping")
+		}
+	}
+}
+
+func TestSetProtocolVersion(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+	adapter.Upgrader.Subprotocols = []string{"chat.v1"}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"chat.v1"}}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	connID := waitForEvent(t, requests, "CONNECT").RequestContext.ConnectionID
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, requests, "MESSAGE")
+
+	// The version defaults to the negotiated subprotocol.
+	stats, err := adapter.ConnectionStats(connID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ProtocolVersion != "chat.v1" {
+		t.Fatalf("expected protocol version chat.v1, got %q", stats.ProtocolVersion)
+	}
+
+	if err := adapter.SetProtocolVersion(connID, "2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := adapter.ConnectionStats(connID); stats.ProtocolVersion != "2.1" {
+		t.Fatalf("expected protocol version 2.1, got %q", stats.ProtocolVersion)
+	}
+
+	var gone *apigatewaymanagementapi.GoneException
+	if err := adapter.SetProtocolVersion("unknown", "2.1"); !errors.As(err, &gone) {
+		t.Fatalf("expected GoneException, got %v", err)
+	}
+}
+
+func TestRouteSelectionExpression(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler:            recordingHandler(requests),
+		RouteSelectionExpression: "$request.body.meta.action",
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	tests := []struct {
+		body     string
+		routeKey string
+	}{
+		{body: `{"meta": {"action": "join"}}`, routeKey: "join"},
+		{body: `{"meta": {"other": "join"}}`, routeKey: "$default"},
+		{body: `{"meta": "join"}`, routeKey: "$default"},
+		{body: `{"action": "join"}`, routeKey: "$default"},
+		{body: `not json`, routeKey: "$default"},
+	}
+
+	for _, tt := range tests {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(tt.body)); err != nil {
+			t.Fatal(err)
+		}
+		if routeKey := waitForEvent(t, requests, "MESSAGE").RequestContext.RouteKey; routeKey != tt.routeKey {
+			t.Errorf("%s: expected route key %s, got %s", tt.body, tt.routeKey, routeKey)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	logs := make(recordingLogger, 100)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{Logger: logs}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.Body == "fail" {
+			return events.APIGatewayProxyResponse{}, errors.New("nope")
+		}
+		return record(ctx, request)
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("fail")); err != nil {
+		t.Fatal(err)
+	}
+	waitForLog(t, logs, "ERROR handler")
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	log.SetOutput(writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return buf.Write(p)
+	}))
+	defer log.SetOutput(os.Stderr)
+
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests), MaxConnections: 1}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	// The second connection is refused and logged synchronously.
+	if _, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil); err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(buf.String(), "WARN too many connections sourceIP=127.0.0.1") {
+		t.Fatalf("expected a warning with key-value pairs, got %q", buf.String())
+	}
+}
+
+// writerFunc is an io.Writer that calls the function.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestWarnOnDiscardedBody(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	logs := make(recordingLogger, 100)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{Logger: logs, WarnOnDiscardedBody: true}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		res, err := record(ctx, request)
+		if request.Body == "reply" {
+			res.Body = "lost"
+		}
+		return res, err
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	select {
+	case message := <-logs:
+		t.Fatalf("unexpected log message %q", message)
+	default:
+	}
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	waitForLog(t, logs, "WARN discarded response body")
+}
+
+func TestWriteBufferPool(t *testing.T) {
+	tests := []struct {
+		name    string
+		adapter *awswebsocketadapter.Adapter
+	}{
+		{name: "small buffers", adapter: &awswebsocketadapter.Adapter{Upgrader: websocket.Upgrader{WriteBufferSize: 64}}},
+		{name: "large buffers", adapter: &awswebsocketadapter.Adapter{Upgrader: websocket.Upgrader{WriteBufferSize: 8192}}},
+		{name: "disabled", adapter: &awswebsocketadapter.Adapter{DisableWriteBufferPool: true}},
+	}
+
+	message := strings.Repeat("x", 10000)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.adapter.LambdaHandler = echoHandler(tt.adapter)
+
+			server := httptest.NewServer(tt.adapter)
+			defer server.Close()
+
+			// Several connections in turn reuse the pooled buffers.
+			for i := 0; i < 3; i++ {
+				ws := dial(t, server)
+
+				if err := ws.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+					t.Fatal(err)
+				}
+				if _, reply, err := ws.ReadMessage(); err != nil || string(reply) != message {
+					t.Fatalf("expected the message to be echoed, got %d bytes, %v", len(reply), err)
+				}
+
+				ws.Close()
+			}
+		})
+	}
+}
+
+func TestWriteBufferPoolMetrics(t *testing.T) {
+	metrics := &recordingMetrics{}
+	adapter := &awswebsocketadapter.Adapter{Metrics: metrics}
+	adapter.LambdaHandler = echoHandler(adapter)
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+
+	// The first write allocates a buffer, which later writes take from the pool again.
+	for i := 0; i < 10; i++ {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if _, reply, err := ws.ReadMessage(); err != nil || string(reply) != "hello" {
+			t.Fatalf("expected the message to be echoed, got %q, %v", reply, err)
+		}
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	if metrics.bufferMisses == 0 || metrics.bufferHits == 0 {
+		t.Fatalf("expected pool hits and misses, got %d hits and %d misses", metrics.bufferHits, metrics.bufferMisses)
+	}
+}
+
+func TestShutdownWhileReceiving(t *testing.T) {
+	const connections = 5
+
+	logs := make(recordingLogger, 1000)
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler: func(context.Context, events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+			return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+		},
+		Logger: logs,
+
+		// Every message and pong moves the read deadline, which races with the deadline of the
+		// close handshake.
+		PingInterval: 5 * time.Millisecond,
+		IdleTimeout:  time.Minute,
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	closeErrs := make(chan error, connections)
+	for i := 0; i < connections; i++ {
+		ws := dial(t, server)
+		defer ws.Close()
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for {
+				if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					closeErrs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := adapter.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < connections; i++ {
+		if err := <-closeErrs; !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("expected going away closure, got %v", err)
+		}
+	}
+	wg.Wait()
+
+	// Failing to move the deadline of a closing connection is not an error.
+	for {
+		select {
+		case message := <-logs:
+			if strings.HasPrefix(message, "ERROR") {
+				t.Errorf("unexpected log message %q", message)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestShutdownWhileConnecting(t *testing.T) {
+	const dialers = 4
+
+	var (
+		mu          sync.Mutex
+		connects    int
+		disconnects int
+	)
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler: func(_ context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch request.RequestContext.EventType {
+			case "CONNECT":
+				connects++
+			case "DISCONNECT":
+				disconnects++
+			}
+			return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+		},
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	shutdown := make(chan struct{})
+	dialErrs := make(chan error, dialers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < dialers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Keep connecting until Shutdown has returned, so that handshakes overlap with all of it.
+			for {
+				select {
+				case <-shutdown:
+					dialErrs <- nil
+					return
+				default:
+				}
+
+				ws, resp, err := websocket.DefaultDialer.Dial(url, nil)
+				if err != nil {
+					if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+						dialErrs <- fmt.Errorf("expected status 503, got %v: %v", resp, err)
+						return
+					}
+					continue
+				}
+
+				// Accepted connections are closed by Shutdown, even if it began during the handshake.
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer ws.Close()
+					for {
+						if _, _, err := ws.ReadMessage(); err != nil {
+							return
+						}
+					}
+				}()
+			}
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := adapter.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	close(shutdown)
+
+	for i := 0; i < dialers; i++ {
+		if err := <-dialErrs; err != nil {
+			t.Error(err)
+		}
+	}
+	wg.Wait()
+
+	// Shutdown waited for every connection that was accepted.
+	mu.Lock()
+	defer mu.Unlock()
+
+	if connects == 0 || connects != disconnects {
+		t.Fatalf("expected a DISCONNECT for each of the CONNECT events, got %d and %d", connects, disconnects)
+	}
+}
+
+func TestOnConnectionClose(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	record := recordingHandler(requests)
+
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	appendOrder := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, event)
+	}
+
+	adapter := &awswebsocketadapter.Adapter{}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.RequestContext.EventType == "DISCONNECT" {
+			appendOrder("DISCONNECT")
+		}
+		return record(ctx, request)
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, connID := connect(t, server, requests)
+	defer ws.Close()
+
+	for _, name := range []string{"first", "second"} {
+		name := name
+		err := adapter.OnConnectionClose(connID, func(reason string) {
+			// The connection is deregistered before the callbacks run.
+			if _, err := adapter.GetConnection(&apigatewaymanagementapi.GetConnectionInput{ConnectionId: &connID}); err == nil {
+				t.Errorf("expected the connection to be gone in callback %s", name)
+			}
+			appendOrder(name)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A server-initiated close runs the callbacks once, in order, before the DISCONNECT handler.
+	if _, err := adapter.DeleteConnection(&apigatewaymanagementapi.DeleteConnectionInput{ConnectionId: &connID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected close code 1000, got %v", err)
+	}
+	waitForEvent(t, requests, "DISCONNECT")
+
+	mu.Lock()
+	got := strings.Join(order, ",")
+	mu.Unlock()
+	if got != "first,second,DISCONNECT" {
+		t.Fatalf("expected first,second,DISCONNECT, got %s", got)
+	}
+
+	// Callbacks cannot be registered for a closed connection.
+	err := adapter.OnConnectionClose(connID, func(string) {})
+	var gone *apigatewaymanagementapi.GoneException
+	if !errors.As(err, &gone) {
+		t.Fatalf("expected GoneException, got %v", err)
+	}
+}
+
+func TestRequestInterceptor(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler: recordingHandler(requests),
+		RequestInterceptor: func(request *events.APIGatewayWebsocketProxyRequest) {
+			request.RequestContext.Stage = "intercepted"
+			if request.RequestContext.EventType == "MESSAGE" {
+				request.Body = strings.ToUpper(request.Body)
+			}
+		},
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+
+	// Every event type passes the interceptor.
+	if stage := waitForEvent(t, requests, "CONNECT").RequestContext.Stage; stage != "intercepted" {
+		t.Fatalf("expected the intercepted stage, got %q", stage)
+	}
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if body := waitForEvent(t, requests, "MESSAGE").Body; body != "HELLO" {
+		t.Fatalf("expected the rewritten body HELLO, got %q", body)
+	}
+
+	ws.Close()
+	if stage := waitForEvent(t, requests, "DISCONNECT").RequestContext.Stage; stage != "intercepted" {
+		t.Fatalf("expected the intercepted stage, got %q", stage)
+	}
+}
+
+func TestResponseInterceptor(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{
+		ResponseInterceptor: func(eventType, connID string, resp *events.APIGatewayProxyResponse) {
+			switch resp.Body {
+			case "normalize":
+				resp.StatusCode = http.StatusOK
+			case "refuse":
+				resp.StatusCode = http.StatusForbidden
+			}
+		},
+	}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if _, err := record(ctx, request); err != nil {
+			return events.APIGatewayProxyResponse{}, err
+		}
+		if request.RequestContext.EventType == "CONNECT" {
+			return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: request.QueryStringParameters["response"]}, nil
+		}
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: request.Body}, nil
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// A successful response turned into an error refuses the handshake.
+	_, resp, err := websocket.DefaultDialer.Dial(url+"?response=refuse", nil)
+	if err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status 403, got %v", resp)
+	}
+	waitForEvent(t, requests, "CONNECT")
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	waitForEvent(t, requests, "CONNECT")
+
+	// A failed response turned into a success is not answered with an error message.
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("normalize")); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, requests, "MESSAGE")
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("fail")); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, requests, "MESSAGE")
+
+	if _, reply, err := ws.ReadMessage(); err != nil || string(reply) != `{"message": "Internal server error"}` {
+		t.Fatalf("expected the error message of the second message only, got %q, %v", reply, err)
+	}
+}
+
+func TestContentTypeDetector(t *testing.T) {
+	tests := []struct {
+		name     string
+		detector func([]byte) string
+		message  string
+		want     string
+	}{
+		{name: "json", message: ` {"action":"echo"}`, want: "json"},
+		{name: "text", message: "hello", want: "text"},
+		{name: "custom", detector: func([]byte) string { return "protobuf" }, message: "hello", want: "protobuf"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentTypes := make(chan string, 10)
+			adapter := &awswebsocketadapter.Adapter{
+				ContentTypeDetector: tt.detector,
+				LambdaHandler: func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+					if request.RequestContext.EventType == "MESSAGE" {
+						contentTypes <- awswebsocketadapter.ContentTypeFromContext(ctx)
+					}
+					return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+				},
+			}
+
+			server := httptest.NewServer(adapter)
+			defer server.Close()
+
+			ws := dial(t, server)
+			defer ws.Close()
+
+			if err := ws.WriteMessage(websocket.TextMessage, []byte(tt.message)); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case contentType := <-contentTypes:
+				if contentType != tt.want {
+					t.Fatalf("expected content type %s, got %q", tt.want, contentType)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for MESSAGE event")
+			}
+		})
+	}
+}
+
+func TestConnectionStatsExtensions(t *testing.T) {
+	tests := []struct {
+		name              string
+		serverCompression bool
+		clientCompression bool
+		want              []string
+	}{
+		{name: "negotiated", serverCompression: true, clientCompression: true, want: []string{"permessage-deflate"}},
+		{name: "server disabled", clientCompression: true},
+		{name: "client disabled", serverCompression: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+			adapter := &awswebsocketadapter.Adapter{LambdaHandler: recordingHandler(requests)}
+			adapter.Upgrader.EnableCompression = tt.serverCompression
+
+			server := httptest.NewServer(adapter)
+			defer server.Close()
+
+			dialer := websocket.Dialer{EnableCompression: tt.clientCompression}
+			ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ws.Close()
+
+			connID := waitForEvent(t, requests, "CONNECT").RequestContext.ConnectionID
+
+			if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			waitForEvent(t, requests, "MESSAGE")
+
+			stats, err := adapter.ConnectionStats(connID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Join(stats.Extensions, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("expected extensions %v, got %v", tt.want, stats.Extensions)
+			}
+		})
+	}
+}
+
+func TestMetricsMessageSizes(t *testing.T) {
+	metrics := &recordingMetrics{}
+	adapter := &awswebsocketadapter.Adapter{Metrics: metrics}
+	adapter.LambdaHandler = echoHandler(adapter)
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+
+	for _, message := range []string{"hello", "hello world"} {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+
+		_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := ws.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	if fmt.Sprint(metrics.inboundSizes) != "[5 11]" {
+		t.Errorf("expected inbound sizes [5 11], got %v", metrics.inboundSizes)
+	}
+	if fmt.Sprint(metrics.outboundSizes) != "[5 11]" {
+		t.Errorf("expected outbound sizes [5 11], got %v", metrics.outboundSizes)
+	}
+}
+
+func TestMetricsUpgradeDuration(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	metrics := &recordingMetrics{}
+	adapter := &awswebsocketadapter.Adapter{
+		Metrics: metrics,
+		LambdaHandler: func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+			if request.RequestContext.EventType == "CONNECT" {
+				time.Sleep(50 * time.Millisecond)
+			}
+			return recordingHandler(requests)(ctx, request)
+		},
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	if len(metrics.upgradeDurations) != 1 {
+		t.Fatalf("expected 1 upgrade duration, got %d", len(metrics.upgradeDurations))
+	}
+	if d := metrics.upgradeDurations[0]; d < 50*time.Millisecond {
+		t.Fatalf("expected upgrade duration to include the CONNECT handler, got %s", d)
+	}
+}
+
+func TestTLSFromContext(t *testing.T) {
+	states := make(chan *tls.ConnectionState, 10)
+	handler := func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.RequestContext.EventType == "CONNECT" {
+			states <- awswebsocketadapter.TLSFromContext(ctx)
+		}
+		return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+	}
+
+	t.Run("tls", func(t *testing.T) {
+		server := httptest.NewTLSServer(&awswebsocketadapter.Adapter{LambdaHandler: handler})
+		defer server.Close()
+
+		dialer := websocket.Dialer{TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig}
+		ws, _, err := dialer.Dial("wss"+strings.TrimPrefix(server.URL, "https"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+
+		if state := <-states; state == nil || !state.HandshakeComplete {
+			t.Fatalf("expected a completed TLS handshake, got %+v", state)
+		}
+	})
+
+	t.Run("plain", func(t *testing.T) {
+		server := httptest.NewServer(&awswebsocketadapter.Adapter{LambdaHandler: handler})
+		defer server.Close()
+
+		ws := dial(t, server)
+		defer ws.Close()
+
+		if state := <-states; state != nil {
+			t.Fatalf("expected no TLS state, got %+v", state)
+		}
+	})
+}
+
+func TestTraceHeadersFromContext(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	tests := []struct {
+		name         string
+		traceHeaders []string
+		header       http.Header
+		want         http.Header
+	}{
+		{
+			name:   "default",
+			header: http.Header{"Traceparent": {traceparent}, "X-Amzn-Trace-Id": {"Root=1-5759e988-bd862e3fe1be46a994272793"}},
+			want:   http.Header{"Traceparent": {traceparent}},
+		},
+		{
+			name:         "custom",
+			traceHeaders: []string{"X-Amzn-Trace-Id"},
+			header:       http.Header{"Traceparent": {traceparent}, "X-Amzn-Trace-Id": {"Root=1-5759e988-bd862e3fe1be46a994272793"}},
+			want:         http.Header{"X-Amzn-Trace-Id": {"Root=1-5759e988-bd862e3fe1be46a994272793"}},
+		},
+		{
+			name: "none",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			traces := make(chan http.Header, 10)
+			adapter := &awswebsocketadapter.Adapter{
+				TraceHeaders: tt.traceHeaders,
+				LambdaHandler: func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+					if request.RequestContext.EventType == "MESSAGE" {
+						traces <- awswebsocketadapter.TraceHeadersFromContext(ctx)
+					}
+					return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+				},
+			}
+
+			server := httptest.NewServer(adapter)
+			defer server.Close()
+
+			ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), tt.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ws.Close()
+
+			if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case trace := <-traces:
+				if fmt.Sprint(trace) != fmt.Sprint(tt.want) {
+					t.Fatalf("expected trace headers %v, got %v", tt.want, trace)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for MESSAGE event")
+			}
+		})
+	}
+}
+
+func TestOnUndeliverable(t *testing.T) {
+	type undeliverable struct {
+		connID string
+		data   string
+		err    error
+	}
+
+	undeliverables := make(chan undeliverable, 10)
+	adapter := &awswebsocketadapter.Adapter{
+		OnUndeliverable: func(connID string, data []byte, err error) {
+			undeliverables <- undeliverable{connID: connID, data: string(data), err: err}
+		},
+	}
+
+	connID := "missing"
+	_, err := adapter.PostToConnection(&apigatewaymanagementapi.PostToConnectionInput{
+		ConnectionId: &connID,
+		Data:         []byte("hello"),
+	})
+
+	var gone *apigatewaymanagementapi.GoneException
+	if !errors.As(err, &gone) {
+		t.Fatalf("expected GoneException, got %v", err)
+	}
+
+	select {
+	case u := <-undeliverables:
+		if u.connID != "missing" || u.data != "hello" || u.err != err {
+			t.Fatalf("expected the undelivered message and its error, got %+v", u)
+		}
+	default:
+		t.Fatal("expected OnUndeliverable to be called")
+	}
+}
+
+func TestFallback(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	fallback := &fallbackAPI{posted: make(chan string, 10)}
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler:               recordingHandler(requests),
+		ConnectionIDPrefix:          "local-",
+		ForeignConnectionIDPrefixes: []string{"other-"},
+		Fallback:                    fallback,
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, connID := connect(t, server, requests)
+	defer ws.Close()
+
+	post := func(connID string) error {
+		_, err := adapter.PostToConnection(&apigatewaymanagementapi.PostToConnectionInput{ConnectionId: &connID, Data: []byte("hi")})
+		return err
+	}
+
+	// Connections of the adapter are not posted to the fallback.
+	if err := post(connID); err != nil {
+		t.Fatal(err)
+	}
+	if _, message, err := ws.ReadMessage(); err != nil || string(message) != "hi" {
+		t.Fatalf("expected the message on the connection, got %q, %v", message, err)
+	}
+
+	// Unknown connections are.
+	if err := post("aws-connection"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case posted := <-fallback.posted:
+		if posted != "aws-connection" {
+			t.Fatalf("expected the fallback to receive aws-connection, got %s", posted)
+		}
+	default:
+		t.Fatal("expected the message to be posted to the fallback")
+	}
+
+	// Connections of other adapters are not.
+	var forbidden *apigatewaymanagementapi.ForbiddenException
+	if err := post("other-connection"); !errors.As(err, &forbidden) {
+		t.Fatalf("expected ForbiddenException, got %v", err)
+	}
+	select {
+	case posted := <-fallback.posted:
+		t.Fatalf("expected nothing to be posted to the fallback, got %s", posted)
+	default:
+	}
+}
+
+func TestCompressionLevelFunc(t *testing.T) {
+	levels := make(chan string, 10)
+	logs := make(recordingLogger, 100)
+	adapter := &awswebsocketadapter.Adapter{
+		Logger: logs,
+		CompressionLevelFunc: func(connID string, r *http.Request) int {
+			levels <- r.URL.Query().Get("level")
+			level, _ := strconv.Atoi(r.URL.Query().Get("level"))
+			return level
+		},
+	}
+	adapter.LambdaHandler = echoHandler(adapter)
+	adapter.Upgrader.EnableCompression = true
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	dialer := websocket.Dialer{EnableCompression: true}
+
+	t.Run("valid", func(t *testing.T) {
+		ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?level=9", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+
+		if level := <-levels; level != "9" {
+			t.Fatalf("expected CompressionLevelFunc to get the upgrade request, got level %q", level)
+		}
+
+		message := strings.Repeat("hello ", 100)
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		if _, reply, err := ws.ReadMessage(); err != nil || string(reply) != message {
+			t.Fatalf("expected the message to be echoed, got %q, %v", reply, err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?level=42", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+
+		<-levels
+		waitForLog(t, logs, "WARN set compression level")
+	})
+}
+
+func TestSlowHandler(t *testing.T) {
+	handler := func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.Body == "slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+	}
+
+	t.Run("callback", func(t *testing.T) {
+		slow := make(chan string, 10)
+		adapter := &awswebsocketadapter.Adapter{
+			LambdaHandler:        handler,
+			SlowHandlerThreshold: 50 * time.Millisecond,
+			OnSlowHandler: func(connID, eventType string, elapsed time.Duration) {
+				if elapsed < 50*time.Millisecond {
+					t.Errorf("expected elapsed time of at least the threshold, got %s", elapsed)
+				}
+				slow <- eventType
+			},
+		}
+
+		server := httptest.NewServer(adapter)
+		defer server.Close()
+
+		ws := dial(t, server)
+		defer ws.Close()
+
+		for _, message := range []string{"fast", "slow"} {
+			if err := ws.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		select {
+		case eventType := <-slow:
+			if eventType != "MESSAGE" {
+				t.Fatalf("expected a slow MESSAGE handler, got %s", eventType)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for OnSlowHandler")
+		}
+
+		select {
+		case eventType := <-slow:
+			t.Fatalf("expected only one slow handler, got another for %s", eventType)
+		case <-time.After(300 * time.Millisecond):
+		}
+	})
+
+	t.Run("log", func(t *testing.T) {
+		logs := make(recordingLogger, 100)
+		adapter := &awswebsocketadapter.Adapter{
+			Logger:               logs,
+			LambdaHandler:        handler,
+			SlowHandlerThreshold: 50 * time.Millisecond,
+		}
+
+		server := httptest.NewServer(adapter)
+		defer server.Close()
+
+		ws := dial(t, server)
+		defer ws.Close()
+
+		if err := ws.WriteMessage(websocket.TextMessage, []byte("slow")); err != nil {
+			t.Fatal(err)
+		}
+		waitForLog(t, logs, "WARN slow handler")
+	})
+}
+
+func TestCloseHandshakeTimeout(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler:         recordingHandler(requests),
+		CloseHandshakeTimeout: 200 * time.Millisecond,
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	t.Run("acknowledged", func(t *testing.T) {
+		ws, connID := connect(t, server, requests)
+		defer ws.Close()
+
+		if _, err := adapter.DeleteConnection(&apigatewaymanagementapi.DeleteConnectionInput{ConnectionId: &connID}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Reading answers the close frame, which completes the handshake.
+		_, _, err := ws.ReadMessage()
+		if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.Fatalf("expected a normal closure, got %v", err)
+		}
+
+		waitForEvent(t, requests, "DISCONNECT")
+	})
+
+	t.Run("unacknowledged", func(t *testing.T) {
+		// The client never reads, so it never answers the close frame.
+		ws, connID := connect(t, server, requests)
+		defer ws.Close()
+
+		start := time.Now()
+		if _, err := adapter.DeleteConnection(&apigatewaymanagementapi.DeleteConnectionInput{ConnectionId: &connID}); err != nil {
+			t.Fatal(err)
+		}
+
+		waitForEvent(t, requests, "DISCONNECT")
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Fatalf("expected DISCONNECT after the close handshake timeout, got it after %s", elapsed)
+		}
+	})
+}
+
+func TestConnectionStatsDurations(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler: func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+			if request.Body == "slow" {
+				time.Sleep(100 * time.Millisecond)
+			}
+			return record(ctx, request)
+		},
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, connID := connect(t, server, requests)
+	defer ws.Close()
+
+	for _, message := range []string{"slow", "sync"} {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForEvent(t, requests, "MESSAGE")
+	// Messages are handled in order, so the slow invocation is recorded once the next one starts.
+	waitForEvent(t, requests, "MESSAGE")
+
+	stats, err := adapter.ConnectionStats(connID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Invocations < 3 {
+		t.Errorf("expected at least 3 invocations, got %d", stats.Invocations)
+	}
+	if stats.MaxHandlerDuration < 100*time.Millisecond {
+		t.Errorf("expected the max handler duration to include the slow handler, got %s", stats.MaxHandlerDuration)
+	}
+	if stats.AvgHandlerDuration <= 0 || stats.AvgHandlerDuration >= stats.MaxHandlerDuration {
+		t.Errorf("expected the average handler duration to be below the max of %s, got %s", stats.MaxHandlerDuration, stats.AvgHandlerDuration)
+	}
+	if stats.LastHandlerDuration > stats.MaxHandlerDuration {
+		t.Errorf("expected the last handler duration to be at most the max of %s, got %s", stats.MaxHandlerDuration, stats.LastHandlerDuration)
+	}
+}
+
+func TestOutboundLatency(t *testing.T) {
+	adapter := &awswebsocketadapter.Adapter{
+		OutboundLatency: 100 * time.Millisecond,
+		OutboundJitter:  50 * time.Millisecond,
+	}
+	adapter.LambdaHandler = echoHandler(adapter)
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+
+	start := time.Now()
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, reply, err := ws.ReadMessage(); err != nil || string(reply) != "hello" {
+		t.Fatalf("expected the message to be echoed, got %q, %v", reply, err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("expected the reply to be delayed by at least 100ms, got it after %s", elapsed)
+	}
+}
+
+func TestYieldEvery(t *testing.T) {
+	adapter := &awswebsocketadapter.Adapter{YieldEvery: 2}
+	adapter.LambdaHandler = echoHandler(adapter)
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	flooder := dial(t, server)
+	defer flooder.Close()
+
+	other := dial(t, server)
+	defer other.Close()
+
+	const count = 100
+	go func() {
+		for i := 0; i < count; i++ {
+			if err := flooder.WriteMessage(websocket.TextMessage, []byte(strconv.Itoa(i))); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Another connection is still served while the flood is handled.
+	if err := other.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, reply, err := other.ReadMessage(); err != nil || string(reply) != "hello" {
+		t.Fatalf("expected the message to be echoed, got %q, %v", reply, err)
+	}
+
+	// Yielding does not drop or reorder messages.
+	_ = flooder.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < count; i++ {
+		if _, reply, err := flooder.ReadMessage(); err != nil || string(reply) != strconv.Itoa(i) {
+			t.Fatalf("expected message %d to be echoed, got %q, %v", i, reply, err)
+		}
+	}
+}
+
+func TestCircuitErrorResponse(t *testing.T) {
+	tests := []struct {
+		name               string
+		circuitOpenMessage []byte
+		errorResponseFunc  func(id json.RawMessage, err error) []byte
+		expected           string
+	}{
+		{name: "default", expected: `{"message":"Service unavailable","id":7}`},
+		{
+			name: "error response func",
+			errorResponseFunc: func(id json.RawMessage, err error) []byte {
+				return []byte(`{"error": "` + err.Error() + `", "id": ` + string(id) + `}`)
+			},
+			expected: `{"error": "circuit open", "id": 7}`,
+		},
+		{
+			name:               "circuit open message",
+			circuitOpenMessage: []byte("busy"),
+			errorResponseFunc: func(json.RawMessage, error) []byte {
+				return []byte("error")
+			},
+			expected: "busy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &awswebsocketadapter.Adapter{
+				LambdaHandler: func(context.Context, events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+					return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+				},
+				MessageIDField:     "id",
+				CircuitOpenMessage: tt.circuitOpenMessage,
+				ErrorResponseFunc:  tt.errorResponseFunc,
+			}
+			adapter.OpenCircuit()
+
+			server := httptest.NewServer(adapter)
+			defer server.Close()
+
+			ws := dial(t, server)
+			defer ws.Close()
+
+			if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"id": 7, "action": "echo"}`)); err != nil {
+				t.Fatal(err)
+			}
+			if _, message, err := ws.ReadMessage(); err != nil || string(message) != tt.expected {
+				t.Fatalf("expected %s, got %q, %v", tt.expected, message, err)
+			}
+		})
+	}
+}
+
+func TestDecompressMessagesErrorResponse(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler:      recordingHandler(requests),
+		DecompressMessages: true,
+		ErrorResponseFunc: func(id json.RawMessage, err error) []byte {
+			return []byte(`{"error": "` + err.Error() + `"}`)
+		},
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+	waitForEvent(t, requests, "CONNECT")
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("not gzip")); err != nil {
+		t.Fatal(err)
+	}
+	if _, reply, err := ws.ReadMessage(); err != nil || string(reply) != `{"error": "invalid compressed message"}` {
+		t.Fatalf("expected the custom error message, got %q, %v", reply, err)
+	}
+	expectNoEvent(t, requests)
+}
+
+func TestMessageTooBigDisconnectStatus(t *testing.T) {
+	type status struct {
+		reason awswebsocketadapter.DisconnectReason
+		code   int
+	}
+
+	disconnects := make(chan status, 1)
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	record := recordingHandler(requests)
+	adapter := &awswebsocketadapter.Adapter{
+		MaxMessageSize: 16,
+		LambdaHandler: func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+			if request.RequestContext.EventType == "DISCONNECT" {
+				code, _ := awswebsocketadapter.DisconnectStatusFromContext(ctx)
+				disconnects <- status{reason: awswebsocketadapter.DisconnectReasonFromContext(ctx), code: code}
+			}
+			return record(ctx, request)
+		},
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	ws, _ := connect(t, server, requests)
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 32))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("expected close code %d, got %v", websocket.CloseMessageTooBig, err)
+	}
+
+	select {
+	case s := <-disconnects:
+		if s.reason != awswebsocketadapter.DisconnectError || s.code != websocket.CloseMessageTooBig {
+			t.Fatalf("expected DISCONNECT with reason %s and code %d, got %s and %d", awswebsocketadapter.DisconnectError, websocket.CloseMessageTooBig, s.reason, s.code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for DISCONNECT event")
+	}
+}
+
+func TestInjectMessageFirstMessageAuth(t *testing.T) {
+	requests := make(chan events.APIGatewayWebsocketProxyRequest, 10)
+	connected := make(chan string, 1)
+	adapter := &awswebsocketadapter.Adapter{
+		LambdaHandler: recordingHandler(requests),
+		OnConnect:     func(connID string) { connected <- connID },
+		FirstMessageAuth: func(connID string, msg []byte) (map[string]interface{}, error) {
+			if string(msg) != "token" {
+				return nil, errors.New("invalid token")
+			}
+			return map[string]interface{}{"principalId": "alice"}, nil
+		},
+	}
+
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	t.Run("authorized", func(t *testing.T) {
+		ws := dial(t, server)
+		defer ws.Close()
+		connID := <-connected
+		waitForEvent(t, requests, "CONNECT")
+
+		for _, message := range []string{"token", "hello"} {
+			if err := adapter.InjectMessage(connID, message); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		request := waitForEvent(t, requests, "MESSAGE")
+		if request.Body != "hello" {
+			t.Fatalf("expected message hello, got %q", request.Body)
+		}
+		authorizer, _ := request.RequestContext.Authorizer.(map[string]interface{})
+		if principal := authorizer["principalId"]; principal != "alice" {
+			t.Fatalf("expected principal alice, got %v", principal)
+		}
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		ws := dial(t, server)
+		defer ws.Close()
+		connID := <-connected
+		waitForEvent(t, requests, "CONNECT")
+
+		if err := adapter.InjectMessage(connID, "forged"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Fatalf("expected close code %d, got %v", websocket.ClosePolicyViolation, err)
+		}
+		// The forged message never reaches the handler.
+		select {
+		case request := <-requests:
+			if request.RequestContext.EventType != "DISCONNECT" {
+				t.Fatalf("expected DISCONNECT, got %s %q", request.RequestContext.EventType, request.Body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for DISCONNECT event")
+		}
+	})
+}
@@ -0,0 +1,89 @@
+// Package awswebsocketadaptertest provides a client for testing Lambda handlers that are served by
+// an awswebsocketadapter.Adapter end to end.
+package awswebsocketadaptertest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/armsnyder/awswebsocketadapter"
+	"github.com/armsnyder/awswebsocketadapter/internal/connid"
+)
+
+// Conn is a client connection to an Adapter for tests, opened with Dial.
+type Conn struct {
+	// ConnectionID is the ID that the adapter assigned to the connection.
+	ConnectionID string
+
+	ws      *websocket.Conn
+	server  *httptest.Server
+	serving sync.WaitGroup
+}
+
+// Dial opens a websocket connection to the adapter through a local test server, for testing the
+// handler together with the management API end to end. It fails if the CONNECT handler refuses
+// the connection.
+func Dial(a *awswebsocketadapter.Adapter) (*Conn, error) {
+	conn := &Conn{}
+	connIDs := make(chan string, 1)
+
+	conn.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn.serving.Add(1)
+		defer conn.serving.Done()
+
+		ctx := connid.WithCallback(r.Context(), func(id string) { connIDs <- id })
+		a.ServeHTTP(w, r.WithContext(ctx))
+	}))
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(conn.server.URL, "http"), nil)
+	if err != nil {
+		conn.server.Close()
+		return nil, err
+	}
+
+	conn.ws = ws
+	conn.ConnectionID = <-connIDs
+
+	return conn, nil
+}
+
+// SendText sends a text message to the adapter.
+func (c *Conn) SendText(message string) error {
+	return c.ws.WriteMessage(websocket.TextMessage, []byte(message))
+}
+
+// ReadText reads the next message from the adapter. It returns a *websocket.CloseError once the
+// adapter has closed the connection.
+func (c *Conn) ReadText() (string, error) {
+	_, message, err := c.ws.ReadMessage()
+	return string(message), err
+}
+
+// Close closes the connection with a close frame, and returns once the adapter has invoked the
+// DISCONNECT handler, unless it does so asynchronously.
+func (c *Conn) Close() error {
+	defer c.server.Close()
+
+	err := c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil && err != websocket.ErrCloseSent {
+		c.ws.Close()
+		c.serving.Wait()
+		return err
+	}
+
+	// Complete the close handshake by reading the adapter's close frame.
+	for {
+		if _, _, err := c.ws.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	err = c.ws.Close()
+	c.serving.Wait()
+
+	return err
+}
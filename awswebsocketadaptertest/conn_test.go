@@ -0,0 +1,80 @@
+package awswebsocketadaptertest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+
+	"github.com/armsnyder/awswebsocketadapter"
+	"github.com/armsnyder/awswebsocketadapter/awswebsocketadaptertest"
+)
+
+func TestDial(t *testing.T) {
+	eventTypes := make(chan string, 10)
+	connIDs := make(chan string, 10)
+
+	adapter := &awswebsocketadapter.Adapter{}
+	adapter.LambdaHandler = func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		eventTypes <- request.RequestContext.EventType
+		connIDs <- request.RequestContext.ConnectionID
+
+		if request.RequestContext.EventType == awswebsocketadapter.EventTypeMessage {
+			_, err := adapter.PostToConnectionWithContext(ctx, &apigatewaymanagementapi.PostToConnectionInput{
+				ConnectionId: &request.RequestContext.ConnectionID,
+				Data:         []byte(request.Body),
+			})
+			if err != nil {
+				return events.APIGatewayProxyResponse{}, err
+			}
+		}
+
+		return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+	}
+
+	conn, err := awswebsocketadaptertest.Dial(adapter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectEvent := func(eventType string) {
+		t.Helper()
+
+		select {
+		case got := <-eventTypes:
+			if got != eventType {
+				t.Fatalf("expected %s event, got %s", eventType, got)
+			}
+			if connID := <-connIDs; connID != conn.ConnectionID {
+				t.Fatalf("expected connection ID %s, got %s", conn.ConnectionID, connID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s event", eventType)
+		}
+	}
+
+	expectEvent(awswebsocketadapter.EventTypeConnect)
+
+	if err := conn.SendText("hello"); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := conn.ReadText(); err != nil || message != "hello" {
+		t.Fatalf("expected message hello, got %q, %v", message, err)
+	}
+	expectEvent(awswebsocketadapter.EventTypeMessage)
+
+	// Close returns after the DISCONNECT handler.
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case eventType := <-eventTypes:
+		if eventType != awswebsocketadapter.EventTypeDisconnect {
+			t.Fatalf("expected DISCONNECT event, got %s", eventType)
+		}
+	default:
+		t.Fatal("expected the DISCONNECT handler to have run")
+	}
+}
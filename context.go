@@ -0,0 +1,127 @@
+package awswebsocketadapter
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// contextKey is the type of the keys of values that the Adapter attaches to handler contexts.
+type contextKey int
+
+const (
+	contentTypeKey contextKey = iota
+	tlsKey
+	traceHeadersKey
+	messageIDKey
+	disconnectReasonKey
+	disconnectStatusKey
+	subprotocolKey
+	adapterKey
+)
+
+// ContentTypeFromContext returns the content type of the message being handled, as classified by
+// Adapter.ContentTypeDetector. It returns an empty string for events other than MESSAGE.
+func ContentTypeFromContext(ctx context.Context) string {
+	contentType, _ := ctx.Value(contentTypeKey).(string)
+	return contentType
+}
+
+// TLSFromContext returns the TLS state of the upgrade request of the connection that the event
+// belongs to, such as the negotiated version and cipher suite. It returns nil if the connection
+// does not use TLS.
+func TLSFromContext(ctx context.Context) *tls.ConnectionState {
+	state, _ := ctx.Value(tlsKey).(*tls.ConnectionState)
+	return state
+}
+
+// TraceHeadersFromContext returns the tracing headers, as selected by Adapter.TraceHeaders, of the
+// upgrade request of the connection that the event belongs to. Tracing middleware can use them to
+// continue the client's trace for every event on the connection.
+func TraceHeadersFromContext(ctx context.Context) http.Header {
+	header, _ := ctx.Value(traceHeadersKey).(http.Header)
+	return header
+}
+
+// SubprotocolFromContext returns the websocket subprotocol that the connection that the event
+// belongs to negotiated from Adapter.Upgrader.Subprotocols, or an empty string if it has none.
+func SubprotocolFromContext(ctx context.Context) string {
+	subprotocol, _ := ctx.Value(subprotocolKey).(string)
+	return subprotocol
+}
+
+// ShuttingDownFromContext reports whether the Adapter that invoked the handler is shutting down,
+// like Adapter.IsShuttingDown, so that handlers can refuse new work. It returns false if ctx is not
+// the context of a handler invocation.
+func ShuttingDownFromContext(ctx context.Context) bool {
+	a, ok := ctx.Value(adapterKey).(*Adapter)
+	return ok && a.IsShuttingDown()
+}
+
+// MessageIDFromContext returns the raw JSON value of the client-provided ID of the message being
+// handled, as selected by Adapter.MessageIDField, or nil if the message has none.
+func MessageIDFromContext(ctx context.Context) json.RawMessage {
+	id, _ := ctx.Value(messageIDKey).(json.RawMessage)
+	return id
+}
+
+// DisconnectReasonFromContext returns the category of the reason that the connection closed. It
+// returns an empty string for events other than DISCONNECT.
+func DisconnectReasonFromContext(ctx context.Context) DisconnectReason {
+	reason, _ := ctx.Value(disconnectReasonKey).(DisconnectReason)
+	return reason
+}
+
+// disconnectStatus is the close code and text of the close frame that ended a connection.
+type disconnectStatus struct {
+	code int
+	text string
+}
+
+// DisconnectStatusFromContext returns the close code and close text of the close frame that ended
+// the connection, like the DisconnectStatusCode and DisconnectReason fields of the request context
+// in API Gateway. The code is 1006 (abnormal closure) if the connection ended without a close
+// frame. It returns zero and an empty string for events other than DISCONNECT.
+func DisconnectStatusFromContext(ctx context.Context) (code int, text string) {
+	status, _ := ctx.Value(disconnectStatusKey).(disconnectStatus)
+	return status.code, status.text
+}
+
+// valuesOnly is a context that carries the values of its parent but not its deadline or
+// cancellation, for work that must outlive the parent.
+type valuesOnly struct {
+	context.Context
+}
+
+func (valuesOnly) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (valuesOnly) Done() <-chan struct{}       { return nil }
+func (valuesOnly) Err() error                  { return nil }
+
+// withTimeout is like context.WithTimeout, except that a timeout of zero or less means no
+// timeout.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// DetectContentType is the default Adapter.ContentTypeDetector. It classifies a message as "json"
+// if it starts with '{' or '[', as "text" if it is otherwise valid UTF-8, and as "binary" if not.
+func DetectContentType(msg []byte) string {
+	trimmed := bytes.TrimSpace(msg)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return "json"
+	}
+
+	if utf8.Valid(msg) {
+		return "text"
+	}
+
+	return "binary"
+}
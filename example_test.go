@@ -4,6 +4,9 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
@@ -13,17 +16,52 @@ import (
 )
 
 func Example() {
-	// Create the adapter.
-	var adapter awswebsocketadapter.Adapter
+	// Create the adapter with a real lambda handler function. The handler uses the adapter as its
+	// management API client, which is assigned before the first event arrives.
+	var adapter *awswebsocketadapter.Adapter
+	handler := func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return createHandler(adapter)(ctx, request)
+	}
 
-	// Set the LambdaHandler to a real lambda handler function.
-	adapter.LambdaHandler = createHandler(&adapter)
+	adapter, err := awswebsocketadapter.New(handler, awswebsocketadapter.WithInvocationTimeout(30*time.Second))
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Listen for ws:// requests.
-	err := http.ListenAndServe(":8080", &adapter)
+	err = http.ListenAndServe(":8080", adapter)
 	log.Fatal(err)
 }
 
+func ExampleAdapter_NewTLSServer() {
+	var adapter awswebsocketadapter.Adapter
+	adapter.LambdaHandler = createHandler(&adapter)
+
+	server := adapter.NewTLSServer(":8443", nil)
+
+	// Stop accepting connections and close the open ones on interrupt.
+	go func() {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		<-interrupt
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			log.Print(err)
+		}
+		if err := adapter.Shutdown(ctx); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	// Listen for wss:// requests.
+	if err := server.ListenAndServeTLS("cert.pem", "key.pem"); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
 // createHandler returns a handler function that can be passed to lambda.Start,
 // from the aws-lambda-go SDK.
 func createHandler(client apigatewaymanagementapiiface.ApiGatewayManagementApiAPI) func(context.Context, events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
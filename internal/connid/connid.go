@@ -0,0 +1,19 @@
+// Package connid lets test clients such as awswebsocketadaptertest.Dial learn the ID that an
+// Adapter assigns to their connection, without adding test plumbing to the public API.
+package connid
+
+import "context"
+
+type callbackKey struct{}
+
+// WithCallback returns a copy of ctx that makes Adapter.ServeHTTP call fn with the ID of the
+// connection of an upgrade request with the context, before invoking the CONNECT handler.
+func WithCallback(ctx context.Context, fn func(connID string)) context.Context {
+	return context.WithValue(ctx, callbackKey{}, fn)
+}
+
+// Callback returns the function set by WithCallback, or nil if there is none.
+func Callback(ctx context.Context) func(connID string) {
+	fn, _ := ctx.Value(callbackKey{}).(func(string))
+	return fn
+}
@@ -0,0 +1,56 @@
+package awswebsocketadapter
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives the log messages of an Adapter, as a message and alternating keys and values
+// such as connectionID, eventType and err. A *slog.Logger satisfies it.
+type Logger interface {
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// stdLogger is the default Logger, which writes to the standard log package.
+type stdLogger struct{}
+
+func (stdLogger) Info(msg string, keysAndValues ...interface{}) {
+	stdLog("INFO", msg, keysAndValues)
+}
+
+func (stdLogger) Warn(msg string, keysAndValues ...interface{}) {
+	stdLog("WARN", msg, keysAndValues)
+}
+
+func (stdLogger) Error(msg string, keysAndValues ...interface{}) {
+	stdLog("ERROR", msg, keysAndValues)
+}
+
+func stdLog(level, msg string, keysAndValues []interface{}) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteByte(' ')
+	b.WriteString(msg)
+
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i+1 < len(keysAndValues) {
+			fmt.Fprintf(&b, " %v=%v", keysAndValues[i], keysAndValues[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v", keysAndValues[i])
+		}
+	}
+
+	log.Print(b.String())
+}
+
+// logger returns the Logger of the adapter.
+func (a *Adapter) logger() Logger {
+	if a.Logger != nil {
+		return a.Logger
+	}
+
+	return stdLogger{}
+}
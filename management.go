@@ -0,0 +1,138 @@
+package awswebsocketadapter
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+)
+
+// managementTimeFormat is the format of the timestamps of the management API, which the SDK parses
+// as ISO 8601.
+const managementTimeFormat = "2006-01-02T15:04:05.999999999Z"
+
+// managementConnectionID returns the connection ID of a management API request for the path
+// /{Stage}/@connections/{connectionId}, or false if r is not one. The ID is escaped in the path,
+// since generated IDs may contain slashes.
+func (a *Adapter) managementConnectionID(r *http.Request) (string, bool) {
+	prefix := "/@connections/"
+	if a.Stage != "" {
+		prefix = "/" + a.Stage + prefix
+	}
+
+	path := r.URL.EscapedPath()
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+
+	connID, err := url.PathUnescape(strings.TrimPrefix(path, prefix))
+	if err != nil || connID == "" {
+		return "", false
+	}
+
+	return connID, true
+}
+
+// serveManagementAPI serves a call of the API Gateway Management API over HTTP for the connection,
+// so that an apigatewaymanagementapi client whose endpoint is built from the DomainName and Stage of
+// an event reaches the adapter. Requests are not authenticated.
+func (a *Adapter) serveManagementAPI(w http.ResponseWriter, r *http.Request, connID string) {
+	switch r.Method {
+	case http.MethodPost:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		input := &apigatewaymanagementapi.PostToConnectionInput{ConnectionId: &connID, Data: data}
+		if _, err := a.PostToConnectionWithContext(r.Context(), input); err != nil {
+			writeManagementError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet:
+		input := &apigatewaymanagementapi.GetConnectionInput{ConnectionId: &connID}
+		output, err := a.GetConnectionWithContext(r.Context(), input)
+		if err != nil {
+			writeManagementError(w, err)
+			return
+		}
+
+		var body struct {
+			ConnectedAt string `json:"connectedAt"`
+			Identity    struct {
+				SourceIP  string `json:"sourceIp"`
+				UserAgent string `json:"userAgent"`
+			} `json:"identity"`
+			LastActiveAt string `json:"lastActiveAt"`
+		}
+		body.ConnectedAt = formatManagementTime(output.ConnectedAt)
+		body.LastActiveAt = formatManagementTime(output.LastActiveAt)
+		if output.Identity != nil {
+			if output.Identity.SourceIp != nil {
+				body.Identity.SourceIP = *output.Identity.SourceIp
+			}
+			if output.Identity.UserAgent != nil {
+				body.Identity.UserAgent = *output.Identity.UserAgent
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(body)
+
+	case http.MethodDelete:
+		input := &apigatewaymanagementapi.DeleteConnectionInput{ConnectionId: &connID}
+		if _, err := a.DeleteConnectionWithContext(r.Context(), input); err != nil {
+			writeManagementError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func formatManagementTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return t.UTC().Format(managementTimeFormat)
+}
+
+// writeManagementError writes err as a management API error response. The SDK turns the response
+// back into the exception named by its error type header.
+func writeManagementError(w http.ResponseWriter, err error) {
+	errorType, status := "", http.StatusInternalServerError
+
+	var (
+		gone      *apigatewaymanagementapi.GoneException
+		forbidden *apigatewaymanagementapi.ForbiddenException
+	)
+	switch {
+	case errors.As(err, &gone):
+		errorType, status = apigatewaymanagementapi.ErrCodeGoneException, http.StatusGone
+	case errors.As(err, &forbidden):
+		errorType, status = apigatewaymanagementapi.ErrCodeForbiddenException, http.StatusForbidden
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if errorType != "" {
+		w.Header().Set("X-Amzn-Errortype", errorType)
+	}
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(struct {
+		Message string `json:"message"`
+	}{err.Error()})
+}
@@ -0,0 +1,26 @@
+package awswebsocketadapter
+
+import "time"
+
+// Metrics receives measurements from an Adapter, for example to build histograms of the traffic
+// it handles. Implementations must be safe for concurrent use.
+type Metrics interface {
+	// ObserveInboundSize is called with the size in bytes of every message received from a client.
+	ObserveInboundSize(size int)
+
+	// ObserveOutboundSize is called with the size in bytes of every message written to a client.
+	ObserveOutboundSize(size int)
+
+	// ObserveUpgradeDuration is called once per connection with the time from receiving the upgrade
+	// request until the connection is ready for messages, including the CONNECT handler.
+	ObserveUpgradeDuration(d time.Duration)
+}
+
+// WriteBufferPoolMetrics can be implemented by Metrics to also observe the pool of write buffers
+// that the Adapter shares between connections, e.g. to size Upgrader.WriteBufferSize. It has no
+// effect if Upgrader.WriteBufferPool is set or DisableWriteBufferPool is.
+type WriteBufferPoolMetrics interface {
+	// ObserveWriteBufferGet is called whenever a connection takes a write buffer from the pool to
+	// write a message, with hit false if the pool was empty and a new buffer is allocated.
+	ObserveWriteBufferGet(hit bool)
+}
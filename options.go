@@ -0,0 +1,163 @@
+package awswebsocketadapter
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Option configures an Adapter created with New.
+type Option struct {
+	name  string
+	apply func(a *Adapter) error
+}
+
+// New returns an Adapter that invokes handler for every event, configured by opts. It validates
+// the configuration, returning an error for a nil handler without WithHandlers, for invalid option
+// values, and for options given more than once.
+//
+// An Adapter can also be configured by setting its fields directly.
+func New(handler LambdaHandler, opts ...Option) (*Adapter, error) {
+	a := &Adapter{LambdaHandler: handler}
+
+	applied := make(map[string]bool, len(opts))
+	for _, opt := range opts {
+		if applied[opt.name] {
+			return nil, fmt.Errorf("option %s given more than once", opt.name)
+		}
+		applied[opt.name] = true
+
+		if err := opt.apply(a); err != nil {
+			return nil, fmt.Errorf("option %s: %w", opt.name, err)
+		}
+	}
+
+	if a.LambdaHandler == nil && len(a.Handlers) == 0 {
+		return nil, errors.New("handler is nil and no Handlers are given")
+	}
+
+	return a, nil
+}
+
+// WithHandlers sets Adapter.Handlers.
+func WithHandlers(handlers map[string]LambdaHandler) Option {
+	return Option{"WithHandlers", func(a *Adapter) error {
+		for routeKey, handler := range handlers {
+			if handler == nil {
+				return fmt.Errorf("handler for route %s is nil", routeKey)
+			}
+		}
+		a.Handlers = handlers
+		return nil
+	}}
+}
+
+// WithInvocationTimeout sets Adapter.InvocationTimeout. A negative timeout means no time limit.
+func WithInvocationTimeout(timeout time.Duration) Option {
+	return Option{"WithInvocationTimeout", func(a *Adapter) error {
+		if timeout == 0 {
+			return errors.New("timeout is zero")
+		}
+		a.InvocationTimeout = timeout
+		return nil
+	}}
+}
+
+// WithConnectTimeout sets Adapter.ConnectTimeout.
+func WithConnectTimeout(timeout time.Duration) Option {
+	return Option{"WithConnectTimeout", func(a *Adapter) error {
+		if timeout <= 0 {
+			return fmt.Errorf("timeout %s is not positive", timeout)
+		}
+		a.ConnectTimeout = timeout
+		return nil
+	}}
+}
+
+// WithWriteTimeout sets Adapter.WriteTimeout.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return Option{"WithWriteTimeout", func(a *Adapter) error {
+		if timeout <= 0 {
+			return fmt.Errorf("timeout %s is not positive", timeout)
+		}
+		a.WriteTimeout = timeout
+		return nil
+	}}
+}
+
+// WithIdleTimeout sets Adapter.IdleTimeout.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return Option{"WithIdleTimeout", func(a *Adapter) error {
+		if timeout <= 0 {
+			return fmt.Errorf("timeout %s is not positive", timeout)
+		}
+		a.IdleTimeout = timeout
+		return nil
+	}}
+}
+
+// WithPingInterval sets Adapter.PingInterval.
+func WithPingInterval(interval time.Duration) Option {
+	return Option{"WithPingInterval", func(a *Adapter) error {
+		if interval <= 0 {
+			return fmt.Errorf("interval %s is not positive", interval)
+		}
+		a.PingInterval = interval
+		return nil
+	}}
+}
+
+// WithMaxMessageSize sets Adapter.MaxMessageSize.
+func WithMaxMessageSize(size int64) Option {
+	return Option{"WithMaxMessageSize", func(a *Adapter) error {
+		if size <= 0 {
+			return fmt.Errorf("size %d is not positive", size)
+		}
+		a.MaxMessageSize = size
+		return nil
+	}}
+}
+
+// WithMaxConcurrentInvocations sets Adapter.MaxConcurrentInvocations.
+func WithMaxConcurrentInvocations(n int) Option {
+	return Option{"WithMaxConcurrentInvocations", func(a *Adapter) error {
+		if n <= 0 {
+			return fmt.Errorf("limit %d is not positive", n)
+		}
+		a.MaxConcurrentInvocations = n
+		return nil
+	}}
+}
+
+// WithMaxConnectionsPerIP sets Adapter.MaxConnectionsPerIP.
+func WithMaxConnectionsPerIP(n int) Option {
+	return Option{"WithMaxConnectionsPerIP", func(a *Adapter) error {
+		if n <= 0 {
+			return fmt.Errorf("limit %d is not positive", n)
+		}
+		a.MaxConnectionsPerIP = n
+		return nil
+	}}
+}
+
+// WithLogger sets Adapter.Logger.
+func WithLogger(logger Logger) Option {
+	return Option{"WithLogger", func(a *Adapter) error {
+		if logger == nil {
+			return errors.New("logger is nil")
+		}
+		a.Logger = logger
+		return nil
+	}}
+}
+
+// WithMetrics sets Adapter.Metrics.
+func WithMetrics(metrics Metrics) Option {
+	return Option{"WithMetrics", func(a *Adapter) error {
+		if metrics == nil {
+			return errors.New("metrics is nil")
+		}
+		a.Metrics = metrics
+		return nil
+	}}
+}
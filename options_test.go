@@ -0,0 +1,106 @@
+package awswebsocketadapter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/armsnyder/awswebsocketadapter"
+)
+
+func noopHandler(context.Context, events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+}
+
+func TestNew(t *testing.T) {
+	adapter, err := awswebsocketadapter.New(noopHandler,
+		awswebsocketadapter.WithInvocationTimeout(time.Second),
+		awswebsocketadapter.WithPingInterval(2*time.Second),
+		awswebsocketadapter.WithMaxMessageSize(1024),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if adapter.LambdaHandler == nil {
+		t.Error("expected LambdaHandler to be set")
+	}
+	if adapter.InvocationTimeout != time.Second {
+		t.Errorf("expected InvocationTimeout 1s, got %s", adapter.InvocationTimeout)
+	}
+	if adapter.PingInterval != 2*time.Second {
+		t.Errorf("expected PingInterval 2s, got %s", adapter.PingInterval)
+	}
+	if adapter.MaxMessageSize != 1024 {
+		t.Errorf("expected MaxMessageSize 1024, got %d", adapter.MaxMessageSize)
+	}
+}
+
+func TestNewWithoutInvocationTimeout(t *testing.T) {
+	adapter, err := awswebsocketadapter.New(noopHandler, awswebsocketadapter.WithInvocationTimeout(-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if adapter.InvocationTimeout >= 0 {
+		t.Errorf("expected a negative InvocationTimeout, got %s", adapter.InvocationTimeout)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler awswebsocketadapter.LambdaHandler
+		opts    []awswebsocketadapter.Option
+	}{
+		{
+			name: "nil handler",
+		},
+		{
+			name:    "zero invocation timeout",
+			handler: noopHandler,
+			opts:    []awswebsocketadapter.Option{awswebsocketadapter.WithInvocationTimeout(0)},
+		},
+		{
+			name:    "negative connect timeout",
+			handler: noopHandler,
+			opts:    []awswebsocketadapter.Option{awswebsocketadapter.WithConnectTimeout(-time.Second)},
+		},
+		{
+			name:    "nil logger",
+			handler: noopHandler,
+			opts:    []awswebsocketadapter.Option{awswebsocketadapter.WithLogger(nil)},
+		},
+		{
+			name:    "duplicate option",
+			handler: noopHandler,
+			opts: []awswebsocketadapter.Option{
+				awswebsocketadapter.WithPingInterval(time.Second),
+				awswebsocketadapter.WithPingInterval(2 * time.Second),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := awswebsocketadapter.New(tt.handler, tt.opts...); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestNewWithHandlers(t *testing.T) {
+	handlers := map[string]awswebsocketadapter.LambdaHandler{"$default": noopHandler}
+
+	adapter, err := awswebsocketadapter.New(nil, awswebsocketadapter.WithHandlers(handlers))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(adapter.Handlers) != 1 {
+		t.Fatalf("expected 1 handler, got %d", len(adapter.Handlers))
+	}
+}
@@ -0,0 +1,30 @@
+package awswebsocketadapter
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// NewTLSServer returns an http.Server that serves the adapter at addr over TLS with config, so that
+// clients can connect with wss://. config may be nil if certificate files are passed to the
+// server's ListenAndServeTLS instead.
+//
+// http.Server.Shutdown does not close websocket connections, so to shut the server down gracefully,
+// call the adapter's Shutdown after it with the same context.
+func (a *Adapter) NewTLSServer(addr string, config *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:      addr,
+		Handler:   a,
+		TLSConfig: config,
+
+		// Websockets are upgraded from HTTP/1.1, so do not negotiate HTTP/2.
+		TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){},
+	}
+}
+
+// ListenAndServeTLS listens on the TCP network address addr and serves the adapter over TLS with
+// the given certificate and key files, like NewTLSServer. It always returns a non-nil error. Use
+// NewTLSServer instead to be able to shut the server down.
+func (a *Adapter) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	return a.NewTLSServer(addr, nil).ListenAndServeTLS(certFile, keyFile)
+}